@@ -0,0 +1,575 @@
+/*
+ * gammaboy is a Game Boy emulator.
+ * Copyright (C) 2018  gammpei
+ *
+ * This file is part of gammaboy.
+ *
+ * gammaboy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * gammaboy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with gammaboy.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+// The APU produces stereo samples at this rate.
+const apuSampleRate = 48000 // Hz
+
+// The Audio Processing Unit.
+type apu struct {
+	square1 squareChannel
+	square2 squareChannel
+	wave    waveChannel
+	noise   noiseChannel
+
+	frameSequencerStep int
+	delayedDivBit      bool // Bit 4 of DIV, the frame sequencer is clocked on its falling edge.
+
+	// Incremented by apuSampleRate every cycle, a sample is taken when it reaches the clock frequency.
+	sampleTimer int
+	// The capacitors of the high-pass filters that remove the DC offset of the DACs.
+	capacitorLeft  float32
+	capacitorRight float32
+	// The samples since the last call to takeAudioSamples, interleaved left and right.
+	samples []float32
+}
+
+func newApu() apu {
+	return apu{
+		square1: squareChannel{base: 0xFF10},
+		square2: squareChannel{base: 0xFF15},
+	}
+}
+
+// Advances the APU by one cycle.
+func (st *st) stepApu() {
+	apu := &st.apu
+
+	var divBit bool
+	if st.doubleSpeed {
+		divBit = getBit_u16(st.timing.systemClock, 13) // Bit 5 of DIV
+	} else {
+		divBit = getBit_u16(st.timing.systemClock, 12) // Bit 4 of DIV
+	}
+	fallingEdge := apu.delayedDivBit && !divBit
+	apu.delayedDivBit = divBit
+
+	NR52 := st.mem[0xFF26] // Sound on/off
+	if getBit(NR52, 7) {
+		if fallingEdge {
+			st.stepFrameSequencer()
+		}
+
+		apu.square1.step(st)
+		apu.square2.step(st)
+		apu.wave.step(st)
+		apu.noise.step(st)
+	}
+
+	apu.sampleTimer += apuSampleRate
+	if apu.sampleTimer >= clockFrequency {
+		apu.sampleTimer -= clockFrequency
+
+		left, right := st.mixApu()
+		// Drop the samples if nobody takes them.
+		if len(apu.samples) < 2*apuSampleRate {
+			apu.samples = append(apu.samples, left, right)
+		}
+	}
+}
+
+// The frame sequencer runs at 512 Hz:
+// the length counters are clocked at 256 Hz, the sweep at 128 Hz and the envelopes at 64 Hz.
+func (st *st) stepFrameSequencer() {
+	apu := &st.apu
+	step := apu.frameSequencerStep
+
+	if step%2 == 0 {
+		stepLength(&apu.square1.length, st.mem[0xFF14], &apu.square1.enabled)
+		stepLength(&apu.square2.length, st.mem[0xFF19], &apu.square2.enabled)
+		stepLength(&apu.wave.length, st.mem[0xFF1E], &apu.wave.enabled)
+		stepLength(&apu.noise.length, st.mem[0xFF23], &apu.noise.enabled)
+	}
+	if step == 2 || step == 6 {
+		apu.square1.stepSweep(st)
+	}
+	if step == 7 {
+		apu.square1.envelope.step(st.mem[0xFF12])
+		apu.square2.envelope.step(st.mem[0xFF17])
+		apu.noise.envelope.step(st.mem[0xFF21])
+	}
+
+	apu.frameSequencerStep = (step + 1) % 8
+}
+
+// The channel is disabled when its length counter reaches 0, if the length is enabled in NRx4.
+func stepLength(length *int, NRx4 u8, enabled *bool) {
+	if getBit(NRx4, 6) && *length > 0 {
+		*length--
+		if *length == 0 {
+			*enabled = false
+		}
+	}
+}
+
+// The stereo output, from -1 to 1.
+func (st *st) mixApu() (float32, float32) {
+	apu := &st.apu
+	NR50 := st.mem[0xFF24] // Channel control / ON-OFF / Volume
+	NR51 := st.mem[0xFF25] // Selection of Sound output terminal
+
+	digital := [4]u8{
+		apu.square1.output(st),
+		apu.square2.output(st),
+		apu.wave.output(st),
+		apu.noise.output(st),
+	}
+	dacEnabled := [4]bool{
+		st.mem[0xFF12]&0xF8 != 0x00,
+		st.mem[0xFF17]&0xF8 != 0x00,
+		getBit(st.mem[0xFF1A], 7),
+		st.mem[0xFF21]&0xF8 != 0x00,
+	}
+
+	var left, right float32
+	for i := uint(0); i < 4; i++ {
+		if !dacEnabled[i] {
+			continue
+		}
+		// The DACs convert 0-15 to -1-1.
+		analog := float32(digital[i])/7.5 - 1
+		if getBit(NR51, i+4) {
+			left += analog
+		}
+		if getBit(NR51, i) {
+			right += analog
+		}
+	}
+	left *= float32((NR50>>4)&0x07+1) / 8 / 4
+	right *= float32(NR50&0x07+1) / 8 / 4
+
+	return apu.highPass(left, &apu.capacitorLeft), apu.highPass(right, &apu.capacitorRight)
+}
+
+func (apu *apu) highPass(in float32, capacitor *float32) float32 {
+	// 0.999958^(cycles per sample)
+	const chargeFactor = 0.99634
+	out := in - *capacitor
+	*capacitor = in - out*chargeFactor
+	return out
+}
+
+// The samples produced since the last call, interleaved left and right.
+func (st *st) takeAudioSamples() []float32 {
+	samples := st.apu.samples
+	st.apu.samples = nil
+	return samples
+}
+
+// The samples that haven't been taken yet aren't included.
+func (apu *apu) sync(s *serializer) {
+	apu.square1.sync(s)
+	apu.square2.sync(s)
+	apu.wave.sync(s)
+	apu.noise.sync(s)
+	s.int(&apu.frameSequencerStep)
+	s.bool(&apu.delayedDivBit)
+	s.int(&apu.sampleTimer)
+	s.float32(&apu.capacitorLeft)
+	s.float32(&apu.capacitorRight)
+}
+
+// The bits that always read as 1 in 0xFF10-0xFF2F.
+var apuReadMasks = [0x20]u8{
+	0x80, 0x3F, 0x00, 0xFF, 0xBF, // NR10-NR14
+	0xFF, 0x3F, 0x00, 0xFF, 0xBF, // NR20-NR24
+	0x7F, 0xFF, 0x9F, 0xFF, 0xBF, // NR30-NR34
+	0xFF, 0xFF, 0x00, 0x00, 0xBF, // NR40-NR44
+	0x00, 0x00, 0x70, // NR50-NR52
+	0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, // Unused
+}
+
+func (st *st) readApu(addr u16) u8 {
+	apu := &st.apu
+	switch {
+	case 0xFF30 <= addr && addr <= 0xFF3F: // Wave Pattern RAM
+		return st.mem[addr]
+	case addr == 0xFF26: // NR52: Sound on/off
+		NR52 := st.mem[addr]&0x80 | apuReadMasks[addr-0xFF10]
+		NR52 = setBit(NR52, 0, apu.square1.enabled)
+		NR52 = setBit(NR52, 1, apu.square2.enabled)
+		NR52 = setBit(NR52, 2, apu.wave.enabled)
+		NR52 = setBit(NR52, 3, apu.noise.enabled)
+		return NR52
+	default:
+		return st.mem[addr] | apuReadMasks[addr-0xFF10]
+	}
+}
+
+func (st *st) writeApu(addr u16, value u8) {
+	apu := &st.apu
+	power := getBit(st.mem[0xFF26], 7)
+
+	switch {
+	case 0xFF30 <= addr && addr <= 0xFF3F: // Wave Pattern RAM
+		st.mem[addr] = value
+		return
+	case addr == 0xFF26: // NR52: Sound on/off
+		if power && !getBit(value, 7) {
+			// Turning the APU off clears its registers.
+			for addr := 0xFF10; addr <= 0xFF25; addr++ {
+				st.mem[addr] = 0x00
+			}
+			apu.square1 = squareChannel{base: 0xFF10}
+			apu.square2 = squareChannel{base: 0xFF15}
+			apu.wave = waveChannel{}
+			apu.noise = noiseChannel{}
+		}
+		if !power && getBit(value, 7) {
+			apu.frameSequencerStep = 0
+		}
+		st.mem[addr] = value & 0x80
+		return
+	case !power:
+		// The registers are read-only while the APU is off.
+		return
+	}
+
+	st.mem[addr] = value
+	switch addr {
+	case 0xFF11: // NR11: Channel 1 Sound length/Wave pattern duty
+		apu.square1.length = 64 - int(value&0x3F)
+	case 0xFF12: // NR12: Channel 1 Volume Envelope
+		if value&0xF8 == 0x00 { // DAC off
+			apu.square1.enabled = false
+		}
+	case 0xFF14: // NR14: Channel 1 Frequency hi
+		if getBit(value, 7) {
+			apu.square1.trigger(st)
+		}
+	case 0xFF16: // NR21: Channel 2 Sound Length/Wave Pattern Duty
+		apu.square2.length = 64 - int(value&0x3F)
+	case 0xFF17: // NR22: Channel 2 Volume Envelope
+		if value&0xF8 == 0x00 { // DAC off
+			apu.square2.enabled = false
+		}
+	case 0xFF19: // NR24: Channel 2 Frequency hi data
+		if getBit(value, 7) {
+			apu.square2.trigger(st)
+		}
+	case 0xFF1A: // NR30: Channel 3 Sound on/off
+		if !getBit(value, 7) { // DAC off
+			apu.wave.enabled = false
+		}
+	case 0xFF1B: // NR31: Channel 3 Sound Length
+		apu.wave.length = 256 - int(value)
+	case 0xFF1E: // NR34: Channel 3 Frequency's higher data
+		if getBit(value, 7) {
+			apu.wave.trigger(st)
+		}
+	case 0xFF20: // NR41: Channel 4 Sound Length
+		apu.noise.length = 64 - int(value&0x3F)
+	case 0xFF21: // NR42: Channel 4 Volume Envelope
+		if value&0xF8 == 0x00 { // DAC off
+			apu.noise.enabled = false
+		}
+	case 0xFF23: // NR44: Channel 4 Counter/consecutive; Inital
+		if getBit(value, 7) {
+			apu.noise.trigger(st)
+		}
+	}
+}
+
+// --------
+// Envelope
+// --------
+
+type envelope struct {
+	volume u8 // 0-15
+	timer  int
+}
+
+func (envelope *envelope) trigger(NRx2 u8) {
+	envelope.volume = NRx2 >> 4
+	envelope.timer = int(NRx2 & 0x07)
+}
+
+func (envelope *envelope) step(NRx2 u8) {
+	period := int(NRx2 & 0x07)
+	if period == 0 {
+		return
+	}
+
+	envelope.timer--
+	if envelope.timer > 0 {
+		return
+	}
+	envelope.timer = period
+
+	increase := getBit(NRx2, 3)
+	if increase && envelope.volume < 15 {
+		envelope.volume++
+	} else if !increase && envelope.volume > 0 {
+		envelope.volume--
+	}
+}
+
+func (envelope *envelope) sync(s *serializer) {
+	s.u8(&envelope.volume)
+	s.int(&envelope.timer)
+}
+
+// -----------------------------
+// Channels 1 and 2: Square wave
+// -----------------------------
+
+type squareChannel struct {
+	base u16 // 0xFF10 for channel 1, 0xFF15 for channel 2.
+
+	enabled  bool
+	timer    int
+	dutyStep int // 0-7
+	length   int
+	envelope envelope
+
+	// Channel 1 only.
+	sweepEnabled bool
+	sweepTimer   int
+	shadowFreq   u16
+}
+
+// 12.5%, 25%, 50% and 75%, from the first step to the last.
+var dutyPatterns = [4]u8{0x01, 0x81, 0x87, 0x7E}
+
+func (ch *squareChannel) freq(st *st) u16 {
+	return u16(st.mem[ch.base+4]&0x07)<<8 | u16(st.mem[ch.base+3])
+}
+
+func (ch *squareChannel) period(st *st) int {
+	return (2048 - int(ch.freq(st))) * 4
+}
+
+func (ch *squareChannel) step(st *st) {
+	ch.timer--
+	if ch.timer <= 0 {
+		ch.timer = ch.period(st)
+		ch.dutyStep = (ch.dutyStep + 1) % 8
+	}
+}
+
+func (ch *squareChannel) output(st *st) u8 {
+	if !ch.enabled {
+		return 0
+	}
+	duty := st.mem[ch.base+1] >> 6
+	if getBit(dutyPatterns[duty], uint(7-ch.dutyStep)) {
+		return ch.envelope.volume
+	}
+	return 0
+}
+
+func (ch *squareChannel) trigger(st *st) {
+	NRx2 := st.mem[ch.base+2]
+	ch.enabled = NRx2&0xF8 != 0x00 // The channel stays off if the DAC is off.
+	if ch.length == 0 {
+		ch.length = 64
+	}
+	ch.timer = ch.period(st)
+	ch.envelope.trigger(NRx2)
+
+	if ch.base == 0xFF10 {
+		NR10 := st.mem[0xFF10] // Channel 1 Sweep register
+		shift := NR10 & 0x07
+		ch.shadowFreq = ch.freq(st)
+		ch.sweepTimer = sweepPeriod(NR10)
+		ch.sweepEnabled = (NR10>>4)&0x07 != 0 || shift != 0
+		if shift != 0 {
+			// Only for the overflow check.
+			ch.sweepFreq(st)
+		}
+	}
+}
+
+// A sweep period of 0 is treated as 8.
+func sweepPeriod(NR10 u8) int {
+	period := int(NR10>>4) & 0x07
+	if period == 0 {
+		return 8
+	}
+	return period
+}
+
+// The next frequency of the sweep, the channel is disabled if it overflows.
+func (ch *squareChannel) sweepFreq(st *st) u16 {
+	NR10 := st.mem[0xFF10] // Channel 1 Sweep register
+	delta := ch.shadowFreq >> (NR10 & 0x07)
+
+	var freq u16
+	if getBit(NR10, 3) { // Decrease
+		freq = ch.shadowFreq - delta
+	} else { // Increase
+		freq = ch.shadowFreq + delta
+	}
+
+	if freq > 2047 {
+		ch.enabled = false
+	}
+	return freq
+}
+
+func (ch *squareChannel) stepSweep(st *st) {
+	ch.sweepTimer--
+	if ch.sweepTimer > 0 {
+		return
+	}
+
+	NR10 := st.mem[0xFF10] // Channel 1 Sweep register
+	ch.sweepTimer = sweepPeriod(NR10)
+	if !ch.sweepEnabled || (NR10>>4)&0x07 == 0 {
+		return
+	}
+
+	freq := ch.sweepFreq(st)
+	if freq <= 2047 && NR10&0x07 != 0 {
+		ch.shadowFreq = freq
+		st.mem[0xFF13] = u8(freq)
+		st.mem[0xFF14] = st.mem[0xFF14]&0xF8 | u8(freq>>8)&0x07
+		// The new frequency is checked for overflow again.
+		ch.sweepFreq(st)
+	}
+}
+
+func (ch *squareChannel) sync(s *serializer) {
+	s.bool(&ch.enabled)
+	s.int(&ch.timer)
+	s.int(&ch.dutyStep)
+	s.int(&ch.length)
+	ch.envelope.sync(s)
+	s.bool(&ch.sweepEnabled)
+	s.int(&ch.sweepTimer)
+	s.u16(&ch.shadowFreq)
+}
+
+// ----------------------
+// Channel 3: Wave output
+// ----------------------
+
+type waveChannel struct {
+	enabled  bool
+	timer    int
+	position int // 0-31, the index of the sample in the wave pattern RAM.
+	length   int
+}
+
+func (ch *waveChannel) period(st *st) int {
+	freq := u16(st.mem[0xFF1E]&0x07)<<8 | u16(st.mem[0xFF1D])
+	return (2048 - int(freq)) * 2
+}
+
+func (ch *waveChannel) step(st *st) {
+	ch.timer--
+	if ch.timer <= 0 {
+		ch.timer = ch.period(st)
+		ch.position = (ch.position + 1) % 32
+	}
+}
+
+func (ch *waveChannel) output(st *st) u8 {
+	if !ch.enabled {
+		return 0
+	}
+
+	// Two 4-bit samples per byte, the upper one first.
+	sample := st.mem[0xFF30+u16(ch.position/2)]
+	if ch.position%2 == 0 {
+		sample >>= 4
+	}
+	sample &= 0x0F
+
+	NR32 := st.mem[0xFF1C]                       // Channel 3 Select output level
+	shift := [4]uint{4, 0, 1, 2}[(NR32>>5)&0x03] // Mute, 100%, 50%, 25%
+	return sample >> shift
+}
+
+func (ch *waveChannel) trigger(st *st) {
+	ch.enabled = getBit(st.mem[0xFF1A], 7) // The channel stays off if the DAC is off.
+	if ch.length == 0 {
+		ch.length = 256
+	}
+	ch.timer = ch.period(st)
+	ch.position = 0
+}
+
+func (ch *waveChannel) sync(s *serializer) {
+	s.bool(&ch.enabled)
+	s.int(&ch.timer)
+	s.int(&ch.position)
+	s.int(&ch.length)
+}
+
+// ----------------
+// Channel 4: Noise
+// ----------------
+
+type noiseChannel struct {
+	enabled  bool
+	timer    int
+	lfsr     u16 // Linear Feedback Shift Register
+	length   int
+	envelope envelope
+}
+
+func (ch *noiseChannel) period(st *st) int {
+	NR43 := st.mem[0xFF22] // Channel 4 Polynomial Counter
+	divisor := [8]int{8, 16, 32, 48, 64, 80, 96, 112}[NR43&0x07]
+	return divisor << (NR43 >> 4)
+}
+
+func (ch *noiseChannel) step(st *st) {
+	ch.timer--
+	if ch.timer > 0 {
+		return
+	}
+	ch.timer = ch.period(st)
+
+	NR43 := st.mem[0xFF22] // Channel 4 Polynomial Counter
+	xor := (ch.lfsr ^ ch.lfsr>>1) & 0x0001
+	ch.lfsr = ch.lfsr>>1 | xor<<14
+	if getBit(NR43, 3) { // 7-bit mode
+		ch.lfsr = ch.lfsr&^0x0040 | xor<<6
+	}
+}
+
+func (ch *noiseChannel) output(st *st) u8 {
+	if !ch.enabled || ch.lfsr&0x0001 != 0 {
+		return 0
+	}
+	return ch.envelope.volume
+}
+
+func (ch *noiseChannel) trigger(st *st) {
+	NR42 := st.mem[0xFF21]         // Channel 4 Volume Envelope
+	ch.enabled = NR42&0xF8 != 0x00 // The channel stays off if the DAC is off.
+	if ch.length == 0 {
+		ch.length = 64
+	}
+	ch.timer = ch.period(st)
+	ch.lfsr = 0x7FFF
+	ch.envelope.trigger(NR42)
+}
+
+func (ch *noiseChannel) sync(s *serializer) {
+	s.bool(&ch.enabled)
+	s.int(&ch.timer)
+	s.u16(&ch.lfsr)
+	s.int(&ch.length)
+	ch.envelope.sync(s)
+}
@@ -0,0 +1,100 @@
+/*
+ * gammaboy is a Game Boy emulator.
+ * Copyright (C) 2018  gammpei
+ *
+ * This file is part of gammaboy.
+ *
+ * gammaboy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * gammaboy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with gammaboy.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func newTestApuState() *st {
+	st := newState(newBankedRom(0x00 /*ROM ONLY*/, 2, 0x00 /*None*/), nil /*linkCable*/, false /*useWallClock*/)
+	st.writeMem(0xFF26, 0x80) // NR52: Sound on
+	st.writeMem(0xFF24, 0x77) // NR50: Full volume
+	st.writeMem(0xFF25, 0xFF) // NR51: All channels to both outputs
+	return st
+}
+
+func TestApuLength(t *testing.T) {
+	st := newTestApuState()
+	st.writeMem(0xFF11, 0x80|0x3E) // NR11: 50% duty, length 2
+	st.writeMem(0xFF12, 0xF0)      // NR12: Volume 15
+	st.writeMem(0xFF14, 0xC7)      // NR14: Trigger, length enabled
+
+	if NR52 := st.readMem(0xFF26); NR52 != 0xF1 {
+		t.Fatalf("Expected NR52=0xF1 after the trigger, got 0x%02X.", NR52)
+	}
+
+	// The length counter is clocked at 256 Hz.
+	st.addCycles(3 * clockFrequency / 256)
+	if NR52 := st.readMem(0xFF26); NR52 != 0xF0 {
+		t.Fatalf("Expected NR52=0xF0 after the length expired, got 0x%02X.", NR52)
+	}
+}
+
+func TestApuSweepOverflow(t *testing.T) {
+	st := newTestApuState()
+	st.writeMem(0xFF10, 0x11) // NR10: Period 1, increase, shift 1
+	st.writeMem(0xFF12, 0xF0) // NR12: Volume 15
+	st.writeMem(0xFF13, 0x00) // NR13
+	st.writeMem(0xFF14, 0x85) // NR14: Trigger, frequency 0x500
+
+	// 0x500 + 0x280 = 0x780 doesn't overflow at the trigger.
+	if !st.apu.square1.enabled {
+		t.Fatalf("Expected channel 1 to be enabled after the trigger.")
+	}
+
+	// The first sweep writes 0x780, then 0x780 + 0x3C0 overflows.
+	st.addCycles(clockFrequency / 64)
+	if freq := u16(st.mem[0xFF14]&0x07)<<8 | u16(st.mem[0xFF13]); freq != 0x780 {
+		t.Fatalf("Expected the sweep to set the frequency to 0x780, got 0x%03X.", freq)
+	}
+	if st.apu.square1.enabled {
+		t.Fatalf("Expected the sweep to disable channel 1.")
+	}
+}
+
+func TestApuSamples(t *testing.T) {
+	st := newTestApuState()
+	st.writeMem(0xFF21, 0xF0) // NR42: Volume 15
+	st.writeMem(0xFF23, 0x80) // NR44: Trigger
+
+	st.addCycles(clockFrequency / 16)
+	samples := st.takeAudioSamples()
+	if len(samples) != 2*apuSampleRate/16 {
+		t.Fatalf("Expected %d samples, got %d.", 2*apuSampleRate/16, len(samples))
+	}
+
+	silent := true
+	for _, sample := range samples {
+		if sample < -1 || sample > 1 {
+			t.Fatalf("Sample %f out of range.", sample)
+		}
+		if sample != 0 {
+			silent = false
+		}
+	}
+	if silent {
+		t.Fatalf("Expected the noise channel to be audible.")
+	}
+	if len(st.takeAudioSamples()) != 0 {
+		t.Fatalf("Expected the samples to be taken.")
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ * gammaboy is a Game Boy emulator.
+ * Copyright (C) 2018  gammpei
+ *
+ * This file is part of gammaboy.
+ *
+ * gammaboy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * gammaboy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with gammaboy.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/veandco/go-sdl2/sdl"
+	"unsafe"
+)
+
+// The amount of audio we try to keep queued in the device, in seconds.
+// A bigger queue is less likely to run dry and crackle, but adds latency.
+const audioLatency = 0.06
+
+// The resampling ratio is adjusted by up to 0.5% to keep the queue at the target size,
+// the pitch change is inaudible.
+const maxRateAdjustment = 0.005
+
+// The audio output through SDL.
+type audio struct {
+	device sdl.AudioDeviceID
+	freq   int // The sample rate of the device.
+
+	// The position of the resampler between the previous frame and the next input frame (0-1).
+	position float64
+	previous [2]float32 // The previous input frame, left and right.
+}
+
+// Returns nil if no audio device can be opened.
+func newAudio() *audio {
+	desired := sdl.AudioSpec{
+		Freq:     apuSampleRate,
+		Format:   sdl.AUDIO_F32SYS,
+		Channels: 2,
+		Samples:  1024,
+	}
+	var obtained sdl.AudioSpec
+	device, err := sdl.OpenAudioDevice(
+		"",    // device, the default one
+		false, // isCapture
+		&desired,
+		&obtained,
+		sdl.AUDIO_ALLOW_FREQUENCY_CHANGE, // allowedChanges
+	)
+	if err != nil {
+		fmt.Printf("Could not open an audio device: %v\n", err)
+		return nil
+	}
+	assert(obtained.Format == sdl.AUDIO_F32SYS && obtained.Channels == 2)
+
+	// Start playing.
+	sdl.PauseAudioDevice(device, false)
+
+	return &audio{
+		device:   device,
+		freq:     int(obtained.Freq),
+		position: 0,
+		previous: [2]float32{0, 0},
+	}
+}
+
+// The queued audio, in seconds.
+func (audio *audio) queued() float64 {
+	const frameSize = 2 * 4 // 2 channels of float32
+	return float64(sdl.GetQueuedAudioSize(audio.device)) / frameSize / float64(audio.freq)
+}
+
+// samples are the APU samples, interleaved left and right.
+func (audio *audio) queue(samples []float32) {
+	queued := audio.queued()
+	if queued > 4*audioLatency {
+		// We are running faster than real time, drop the samples instead of adding latency.
+		return
+	}
+
+	// Produce a bit less output when the queue is too full, a bit more when it is too empty.
+	fill := (audioLatency - queued) / audioLatency
+	if fill < -1 {
+		fill = -1
+	}
+	ratio := float64(audio.freq) / apuSampleRate * (1 + maxRateAdjustment*fill)
+	step := 1 / ratio
+
+	// Linear interpolation between the input frames.
+	output := make([]float32, 0, int(float64(len(samples))*ratio)+2)
+	for i := 0; i+1 < len(samples); i += 2 {
+		next := [2]float32{samples[i], samples[i+1]}
+		for ; audio.position < 1; audio.position += step {
+			t := float32(audio.position)
+			output = append(output,
+				audio.previous[0]+(next[0]-audio.previous[0])*t,
+				audio.previous[1]+(next[1]-audio.previous[1])*t,
+			)
+		}
+		audio.position--
+		audio.previous = next
+	}
+	if len(output) == 0 {
+		return
+	}
+
+	data := (*[1 << 30]u8)(unsafe.Pointer(&output[0]))[: len(output)*4 : len(output)*4]
+	err := sdl.QueueAudio(audio.device, data)
+	check(err)
+}
+
+func (audio *audio) close() {
+	sdl.CloseAudioDevice(audio.device)
+}
@@ -0,0 +1,84 @@
+/*
+ * gammaboy is a Game Boy emulator.
+ * Copyright (C) 2018  gammpei
+ *
+ * This file is part of gammaboy.
+ *
+ * gammaboy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * gammaboy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with gammaboy.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The battery-backed external ram of a cartridge, persisted to a .sav file.
+type saveFile struct {
+	path     string
+	mbc      mbc
+	lastData []u8 // What is currently in the file, without the timestamp.
+}
+
+// The RTC footer changes every second with a running clock, but the timestamp
+// is enough to restore it with the wall time: only the ram, the latched registers
+// and the halt bit are compared.
+var noTimestamp = time.Unix(0, 0)
+
+// game.gb -> game.sav
+func savePath(romPath string) string {
+	return strings.TrimSuffix(romPath, filepath.Ext(romPath)) + ".sav"
+}
+
+func newSaveFile(path string, mbc mbc) *saveFile {
+	saveFile := &saveFile{
+		path:     path,
+		mbc:      mbc,
+		lastData: nil,
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return saveFile
+	}
+	check(err)
+
+	fmt.Printf("Loading %s\n", path)
+	mbc.loadSaveData(data)
+	saveFile.lastData = mbc.saveData(noTimestamp)
+	return saveFile
+}
+
+// Writes the save file if the ram (or the RTC settings) changed since the last flush.
+func (saveFile *saveFile) flush() {
+	data := saveFile.mbc.saveData(noTimestamp)
+	if bytes.Equal(data, saveFile.lastData) {
+		return
+	}
+	saveFile.lastData = data
+	data = saveFile.mbc.saveData(time.Now())
+
+	// Write to a temporary file first so that a crash can't leave a truncated save.
+	tmpPath := saveFile.path + ".tmp"
+	err := ioutil.WriteFile(tmpPath, data, 0644)
+	check(err)
+	err = os.Rename(tmpPath, saveFile.path)
+	check(err)
+}
@@ -0,0 +1,253 @@
+/*
+ * gammaboy is a Game Boy emulator.
+ * Copyright (C) 2018  gammpei
+ *
+ * This file is part of gammaboy.
+ *
+ * gammaboy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * gammaboy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with gammaboy.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// The cartridge header at 0x0100-0x014F.
+// (The fields are exported for encoding/json.)
+type cartridgeHeader struct {
+	Title            string `json:"title"`            // 0x0134-0x0143
+	ManufacturerCode string `json:"manufacturerCode"` // 0x013F-0x0142
+	CgbFlag          u8     `json:"cgbFlag"`          // 0x0143
+	Cgb              string `json:"cgb"`
+	SgbFlag          u8     `json:"sgbFlag"` // 0x0146
+	Sgb              bool   `json:"sgb"`
+	CartridgeType    u8     `json:"cartridgeType"` // 0x0147
+	Mapper           string `json:"mapper"`
+	RomSizeCode      u8     `json:"romSizeCode"`     // 0x0148
+	RomSize          int    `json:"romSize"`         // In bytes, 0 if the code is invalid.
+	RamSizeCode      u8     `json:"ramSizeCode"`     // 0x0149
+	RamSize          int    `json:"ramSize"`         // In bytes.
+	DestinationCode  u8     `json:"destinationCode"` // 0x014A
+	Licensee         string `json:"licensee"`        // 0x014B, or 0x0144-0x0145 if 0x014B is 0x33
+	LicenseeName     string `json:"licenseeName"`    // "unknown (code)" if it isn't in our tables.
+	Version          u8     `json:"version"`         // 0x014C
+
+	HeaderChecksum      u8   `json:"headerChecksum"` // 0x014D
+	HeaderChecksumValid bool `json:"headerChecksumValid"`
+	GlobalChecksum      u16  `json:"globalChecksum"` // 0x014E-0x014F
+	GlobalChecksumValid bool `json:"globalChecksumValid"`
+
+	Sha256 string `json:"sha256"`
+
+	licenseeKnown bool // Whether the licensee is in our tables.
+}
+
+func parseCartridgeHeader(rom []u8) *cartridgeHeader {
+	assert(len(rom) >= 0x0150)
+
+	header := &cartridgeHeader{
+		CgbFlag:         rom[0x0143],
+		SgbFlag:         rom[0x0146],
+		Sgb:             rom[0x0146] == 0x03,
+		CartridgeType:   rom[0x0147],
+		Mapper:          cartridgeTypeName(rom[0x0147]),
+		RomSizeCode:     rom[0x0148],
+		RamSizeCode:     rom[0x0149],
+		DestinationCode: rom[0x014A],
+		Version:         rom[0x014C],
+		HeaderChecksum:  rom[0x014D],
+		GlobalChecksum:  u16(rom[0x014E])<<8 | u16(rom[0x014F]),
+		Sha256:          sha256Hash(rom),
+	}
+
+	// In CGB cartridges, the end of the title area is used for the manufacturer code and the CGB flag.
+	title := rom[0x0134:0x0144]
+	switch header.CgbFlag {
+	case 0x80:
+		header.Cgb = "CGB compatible"
+		title = rom[0x0134:0x0143]
+	case 0xC0:
+		header.Cgb = "CGB only"
+		title = rom[0x0134:0x0143]
+	default:
+		header.Cgb = "DMG only"
+	}
+	if getBit(header.CgbFlag, 7) && isManufacturerCode(rom[0x013F:0x0143]) {
+		header.ManufacturerCode = string(rom[0x013F:0x0143])
+		title = rom[0x0134:0x013F]
+	}
+	header.Title = strings.TrimRight(string(title), "\x00")
+
+	if header.RomSizeCode <= 0x08 {
+		header.RomSize = (32 * 1024) << header.RomSizeCode
+	}
+	if header.RamSizeCode <= 0x05 {
+		header.RamSize = ramSize(header.RamSizeCode)
+	}
+
+	if rom[0x014B] == 0x33 {
+		header.Licensee = string(rom[0x0144:0x0146])
+		header.LicenseeName, header.licenseeKnown = newLicensees[header.Licensee]
+	} else {
+		header.Licensee = fmt.Sprintf("0x%02X", rom[0x014B])
+		header.LicenseeName, header.licenseeKnown = oldLicensees[rom[0x014B]]
+	}
+	if !header.licenseeKnown {
+		header.LicenseeName = "unknown (" + header.Licensee + ")"
+	}
+
+	header.HeaderChecksumValid = headerChecksum(rom) == header.HeaderChecksum
+	header.GlobalChecksumValid = globalChecksum(rom) == header.GlobalChecksum
+
+	return header
+}
+
+func isManufacturerCode(code []u8) bool {
+	for _, c := range code {
+		if !('A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// The bios refuses to boot if this checksum is wrong.
+func headerChecksum(rom []u8) u8 {
+	var x u8 = 0
+	for addr := 0x0134; addr <= 0x014C; addr++ {
+		x = x - rom[addr] - 1
+	}
+	return x
+}
+
+// The sum of all the bytes of the rom, except the checksum itself. It isn't verified by the hardware.
+func globalChecksum(rom []u8) u16 {
+	var x u16 = 0
+	for addr, b := range rom {
+		if addr != 0x014E && addr != 0x014F {
+			x += u16(b)
+		}
+	}
+	return x
+}
+
+func cartridgeTypeName(cartridgeType u8) string {
+	names := map[u8]string{
+		0x00: "ROM ONLY",
+		0x01: "MBC1",
+		0x02: "MBC1+RAM",
+		0x03: "MBC1+RAM+BATTERY",
+		0x05: "MBC2",
+		0x06: "MBC2+BATTERY",
+		0x08: "ROM+RAM",
+		0x09: "ROM+RAM+BATTERY",
+		0x0B: "MMM01",
+		0x0C: "MMM01+RAM",
+		0x0D: "MMM01+RAM+BATTERY",
+		0x0F: "MBC3+TIMER+BATTERY",
+		0x10: "MBC3+TIMER+RAM+BATTERY",
+		0x11: "MBC3",
+		0x12: "MBC3+RAM",
+		0x13: "MBC3+RAM+BATTERY",
+		0x19: "MBC5",
+		0x1A: "MBC5+RAM",
+		0x1B: "MBC5+RAM+BATTERY",
+		0x1C: "MBC5+RUMBLE",
+		0x1D: "MBC5+RUMBLE+RAM",
+		0x1E: "MBC5+RUMBLE+RAM+BATTERY",
+		0x20: "MBC6",
+		0x22: "MBC7+SENSOR+RUMBLE+RAM+BATTERY",
+		0xFC: "POCKET CAMERA",
+		0xFD: "BANDAI TAMA5",
+		0xFE: "HuC3",
+		0xFF: "HuC1+RAM+BATTERY",
+	}
+	name, ok := names[cartridgeType]
+	if !ok {
+		return "Unknown"
+	}
+	return name
+}
+
+// Only the most common licensees.
+var oldLicensees = map[u8]string{
+	0x00: "None",
+	0x01: "Nintendo",
+	0x08: "Capcom",
+	0x13: "Electronic Arts",
+	0x18: "Hudson Soft",
+	0x31: "Nintendo",
+	0x41: "Ubi Soft",
+	0x52: "Activision",
+	0x69: "Electronic Arts",
+	0xA4: "Konami",
+}
+
+var newLicensees = map[string]string{
+	"00": "None",
+	"01": "Nintendo",
+	"08": "Capcom",
+	"13": "Electronic Arts",
+	"18": "Hudson Soft",
+	"41": "Ubi Soft",
+	"52": "Activision",
+	"69": "Electronic Arts",
+	"A4": "Konami",
+}
+
+func (header *cartridgeHeader) print() {
+	validity := func(valid bool) string {
+		if valid {
+			return "OK"
+		}
+		return "INVALID"
+	}
+	size := func(size int) string {
+		switch {
+		case size == 0:
+			return "None"
+		case size%(1024*1024) == 0:
+			return fmt.Sprintf("%d MiB", size/(1024*1024))
+		default:
+			return fmt.Sprintf("%d KiB", size/1024)
+		}
+	}
+
+	fmt.Printf("Title:             %s\n", header.Title)
+	fmt.Printf("Manufacturer code: %s\n", header.ManufacturerCode)
+	fmt.Printf("CGB:               %s (0x%02X)\n", header.Cgb, header.CgbFlag)
+	fmt.Printf("SGB:               %v (0x%02X)\n", header.Sgb, header.SgbFlag)
+	fmt.Printf("Cartridge type:    %s (0x%02X)\n", header.Mapper, header.CartridgeType)
+	fmt.Printf("ROM size:          %s (0x%02X)\n", size(header.RomSize), header.RomSizeCode)
+	fmt.Printf("RAM size:          %s (0x%02X)\n", size(header.RamSize), header.RamSizeCode)
+	fmt.Printf("Destination code:  0x%02X\n", header.DestinationCode)
+	if header.licenseeKnown {
+		fmt.Printf("Licensee:          %s (%s)\n", header.LicenseeName, header.Licensee)
+	} else {
+		fmt.Printf("Licensee:          %s\n", header.LicenseeName)
+	}
+	fmt.Printf("Version:           %d\n", header.Version)
+	fmt.Printf("Header checksum:   0x%02X (%s)\n", header.HeaderChecksum, validity(header.HeaderChecksumValid))
+	fmt.Printf("Global checksum:   0x%04X (%s)\n", header.GlobalChecksum, validity(header.GlobalChecksumValid))
+	fmt.Printf("SHA-256:           %s\n", header.Sha256)
+}
+
+func (header *cartridgeHeader) printJson() {
+	b, err := json.MarshalIndent(header, "", "  ")
+	check(err)
+	fmt.Println(string(b))
+}
@@ -0,0 +1,90 @@
+/*
+ * gammaboy is a Game Boy emulator.
+ * Copyright (C) 2018  gammpei
+ *
+ * This file is part of gammaboy.
+ *
+ * gammaboy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * gammaboy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with gammaboy.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCartridgeHeader(t *testing.T) {
+	rom := newBankedRom(0x13 /*MBC3+RAM+BATTERY*/, 64, 0x03 /*32KB*/)
+	copy(rom[0x0134:], "POKEMON_SLVAAXE")
+	rom[0x0143] = 0x80 // CGB compatible
+	rom[0x014B] = 0x33
+	copy(rom[0x0144:], "01")
+	rom[0x0146] = 0x03 // SGB
+	rom[0x0148] = 0x05 // 1 MiB
+	rom[0x014C] = 0x01
+	rom[0x014D] = headerChecksum(rom)
+	checksum := globalChecksum(rom)
+	rom[0x014E] = u8(checksum >> 8)
+	rom[0x014F] = u8(checksum)
+
+	header := parseCartridgeHeader(rom)
+	if header.Title != "POKEMON_SLV" || header.ManufacturerCode != "AAXE" {
+		t.Fatalf(`Unexpected title %q and manufacturer code %q.`, header.Title, header.ManufacturerCode)
+	}
+	if header.Cgb != "CGB compatible" || !header.Sgb {
+		t.Fatalf(`Unexpected CGB %q or SGB %v.`, header.Cgb, header.Sgb)
+	}
+	if header.Mapper != "MBC3+RAM+BATTERY" || header.RomSize != 1024*1024 || header.RamSize != 32*1024 {
+		t.Fatalf(`Unexpected mapper %q, rom size %d or ram size %d.`, header.Mapper, header.RomSize, header.RamSize)
+	}
+	if header.Licensee != "01" || header.LicenseeName != "Nintendo" || header.Version != 1 {
+		t.Fatalf(`Unexpected licensee %q %q or version %d.`, header.Licensee, header.LicenseeName, header.Version)
+	}
+	if !header.HeaderChecksumValid || !header.GlobalChecksumValid {
+		t.Fatalf(`Expected valid checksums.`)
+	}
+
+	rom[0x0134] = 'Q'
+	header = parseCartridgeHeader(rom)
+	if header.HeaderChecksumValid || header.GlobalChecksumValid {
+		t.Fatalf(`Expected invalid checksums.`)
+	}
+}
+
+func TestCartridgeHeaderUnknownLicensee(t *testing.T) {
+	rom := newBankedRom(0x00 /*ROM ONLY*/, 2, 0x00 /*None*/)
+	for _, c := range []struct {
+		oldCode  u8
+		newCode  string
+		expected string
+	}{
+		{0xEE, "", "unknown (0xEE)"},
+		{0x33, "ZZ", "unknown (ZZ)"},
+	} {
+		rom[0x014B] = c.oldCode
+		copy(rom[0x0144:], c.newCode)
+		header := parseCartridgeHeader(rom)
+		if header.LicenseeName != c.expected {
+			t.Fatalf(`Expected the licensee %q, got %q.`, c.expected, header.LicenseeName)
+		}
+
+		b, err := json.Marshal(header)
+		check(err)
+		if !strings.Contains(string(b), `"licenseeName":"`+c.expected+`"`) {
+			t.Fatalf(`Expected the licensee %q in the JSON, got %s.`, c.expected, b)
+		}
+	}
+}
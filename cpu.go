@@ -25,7 +25,10 @@ import (
 	"reflect"
 )
 
-func fetchDecodeExecute(st *st) {
+// Returns the number of cycles taken by the instruction, they are already added to the clock.
+func fetchDecodeExecute(st *st) int {
+	st.timing.instrCycles = 0
+
 	// Log the registers
 	if flags.verbose {
 		fmt.Printf("PC=0x%04X AF=0x%04X BC=0x%04X DE=0x%04X HL=0x%04X SP=0x%04X\n",
@@ -35,7 +38,14 @@ func fetchDecodeExecute(st *st) {
 
 	// Fetch
 	PC_0 := PC.get(st)
-	opcode := st.readMem(PC_0)
+	opcode := st.readCycle(PC_0)
+
+	// After the HALT bug, PC isn't incremented after the opcode so the next byte is read twice.
+	var haltBug u16 = 0
+	if st.haltBug {
+		st.haltBug = false
+		haltBug = 1
+	}
 
 	// Decode
 	var sizeOfOpcode u16
@@ -48,17 +58,22 @@ func fetchDecodeExecute(st *st) {
 		}
 	} else {
 		sizeOfOpcode = 2
-		opcode = st.readMem(PC_0 + 1)
+		opcode = st.readCycle(PC_0 + 1 - haltBug)
 		instr = extendedJumpTable[opcode]
 		if instr == nil {
 			panic(fmt.Sprintf("Unknown extended opcode 0xCB-0x%02X=0b%08b at 0x%04X.", opcode, opcode, PC_0))
 		}
 	}
 
+	// Fetch the immediate operands
+	for i := u16(0); i < instr.sizeOfOperands; i++ {
+		st.immediate[i] = st.readCycle(PC_0 + sizeOfOpcode + i - haltBug)
+	}
+
 	// Increment PC
 	sizeOfInstr := sizeOfOpcode + instr.sizeOfOperands
 	assert(1 <= sizeOfInstr && sizeOfInstr <= 3)
-	PC.set(st, PC_0+sizeOfInstr)
+	PC.set(st, PC_0+sizeOfInstr-haltBug)
 
 	// Log the instruction
 	if flags.verbose {
@@ -77,14 +92,29 @@ func fetchDecodeExecute(st *st) {
 		fmt.Println(" " + instrBytes + " | " + instr.toString(st))
 	}
 
+	// The condition has to be evaluated before the execution, which could change the flags.
+	cycles := instr.cycles
+	if instr.condition != nil && instr.condition.get(st) {
+		cycles = instr.cyclesIfTaken
+	}
+
 	// Execute
 	instr.execute(st)
+
+	// The internal delays of the instruction, after its memory accesses.
+	assert(st.timing.instrCycles <= cycles)
+	st.addCycles(cycles - st.timing.instrCycles)
+	return cycles
 }
 
 type instr struct {
 	sizeOfOperands u16
 	toString       func(*st) string
 	execute        func(*st)
+
+	cycles        int
+	condition     r_bool // nil if the instruction isn't conditional.
+	cyclesIfTaken int
 }
 
 type operation struct {
@@ -101,7 +131,7 @@ type operand interface {
 	toString(*st) string
 }
 
-func newInstr(operation *operation, operands []operand) *instr {
+func newInstr(operation *operation, operands []operand, cycles int) *instr {
 	var sizeOfOperands u16 = 0
 	for _, operand := range operands {
 		sizeOfOperands += operand.sizeOf()
@@ -201,7 +231,14 @@ func newInstr(operation *operation, operands []operand) *instr {
 		panic(fmt.Sprintf("Unimplemented function type %T in %s.", operation.f, operation.name))
 	}
 
-	return &instr{sizeOfOperands, toString, execute}
+	var condition r_bool = nil
+	cyclesIfTaken := cycles
+	if extraCycles, ok := takenCycles[operation]; ok {
+		condition = operands[0].(r_bool)
+		cyclesIfTaken += extraCycles
+	}
+
+	return &instr{sizeOfOperands, toString, execute, cycles, condition, cyclesIfTaken}
 }
 
 type r_bool interface {
@@ -236,6 +236,20 @@ var EI = &operation{"EI", func(st *st) {
 	st.IME = true
 }}
 
+// pandocs.htm
+// halt           76         N*4 ---- halt until interrupt occurs (low power)
+var HALT = &operation{"HALT", func(st *st) {
+	IF := st.readMem(0xFF0F) // IF: Interrupt Flag
+	IE := st.readMem(0xFFFF) // IE: Interrupt Enable
+	if !st.IME && IF&IE&0x1F != 0x00 {
+		// The HALT bug: with an interrupt already pending and IME=0,
+		// the CPU doesn't halt and fails to increment PC after the next opcode.
+		st.haltBug = true
+	} else {
+		st.halted = true
+	}
+}}
+
 // UM0080.pdf rev 11 p179,181 / 332
 var INC_u8 = &operation{"INC", func(st *st, x rw_u8) {
 	v1 := x.get(st)
@@ -338,15 +352,22 @@ var OR = &operation{"OR", func(st *st, x r_u8) {
 // UM0080.pdf rev 11 p133 / 332
 var POP = &operation{"POP", func(st *st, x w_u16) {
 	top := SP.get(st)
-	x.set(st, st.readMem_u16(top))
+	low := st.readCycle(top)
+	high := st.readCycle(top + 1)
+	x.set(st, u16(high)<<8|u16(low))
 	SP.set(st, top+2)
 }}
 
 // UM0080.pdf rev 11 p129 / 332
 var PUSH = &operation{"PUSH", func(st *st, x r_u16) {
+	value := x.get(st)
 	top := SP.get(st) - 2
 	SP.set(st, top)
-	st.writeMem_u16(top, x.get(st))
+
+	// An internal delay, then the high byte is written first.
+	st.cycle()
+	st.writeCycle(top+1, u8(value>>8))
+	st.writeCycle(top, u8(value))
 }}
 
 // UM0080.pdf rev 11 p273 / 332
@@ -362,6 +383,8 @@ var RET0 = &operation{"RET", func(st *st) {
 
 // UM0080.pdf rev 11 p300 / 332
 var RET1 = &operation{"RET", func(st *st, x r_bool) {
+	// An internal delay to check the condition.
+	st.cycle()
 	if x.get(st) {
 		RET0.f.(func(*state))(st)
 	}
@@ -541,10 +564,35 @@ var SRL = &operation{"SRL", func(st *st, x rw_u8) {
 	F.C.set(st, oldBit0)
 }}
 
+// pandocs.htm
+// stop           10 00        ? ---- low power standby mode (VERY low power)
+// On the CGB, STOP performs the speed switch instead if it was prepared in KEY1.
+var STOP = &operation{"STOP", func(st *st) {
+	// The byte after STOP is skipped.
+	PC.set(st, PC.get(st)+1)
+	st.timing.systemClock = 0x0000 // DIV is reset.
+
+	KEY1 := st.readMem(0xFF4D) // KEY1: Prepare speed switch
+	if st.cgb && getBit(KEY1, 0) {
+		st.doubleSpeed = !st.doubleSpeed
+		st.writeMem(0xFF4D, 0x00)
+		// The CPU is stopped while the clock changes.
+		st.addCycles(speedSwitchCycles)
+		st.timing.systemClock = 0x0000
+		return
+	}
+	st.stopped = true
+}}
+
+// The speed switch takes 2050 M-cycles.
+const speedSwitchCycles = 2050 * 4
+
 // UM0080.pdf rev 11 p167 / 332
 var SUB = &operation{"SUB", func(st *st, x r_u8) {
-	CP.f.(func(*state, r_u8))(st, x)
-	A.set(st, A.get(st)-x.get(st))
+	// x is only read once, (HL) would take another cycle.
+	v := const_u8(x.get(st))
+	CP.f.(func(*state, r_u8))(st, v)
+	A.set(st, A.get(st)-u8(v))
 }}
 
 // pandocs.htm
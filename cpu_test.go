@@ -0,0 +1,238 @@
+/*
+ * gammaboy is a Game Boy emulator.
+ * Copyright (C) 2018  gammpei
+ *
+ * This file is part of gammaboy.
+ *
+ * gammaboy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * gammaboy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with gammaboy.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestInstrCycles(t *testing.T) {
+	tests := []struct {
+		name   string
+		code   []u8
+		zero   bool // The Z flag before the instruction.
+		cycles int
+	}{
+		{"NOP", []u8{0x00}, false, 4},
+		{"LD BC,N", []u8{0x01, 0x34, 0x12}, false, 12},
+		{"LD (N),SP", []u8{0x08, 0x00, 0xC0}, false, 20},
+		{"LD B,(HL)", []u8{0x46}, false, 8},
+		{"PUSH BC", []u8{0xC5}, false, 16},
+		{"JR NZ not taken", []u8{0x20, 0x05}, true, 8},
+		{"JR NZ taken", []u8{0x20, 0x05}, false, 12},
+		{"JP Z not taken", []u8{0xCA, 0x00, 0x02}, false, 12},
+		{"JP Z taken", []u8{0xCA, 0x00, 0x02}, true, 16},
+		{"CALL NZ not taken", []u8{0xC4, 0x00, 0x02}, true, 12},
+		{"CALL NZ taken", []u8{0xC4, 0x00, 0x02}, false, 24},
+		{"RET Z not taken", []u8{0xC8}, false, 8},
+		{"RET Z taken", []u8{0xC8}, true, 20},
+		{"RLC B", []u8{0xCB, 0x00}, false, 8},
+		{"BIT 0,(HL)", []u8{0xCB, 0x46}, false, 12},
+		{"SET 0,(HL)", []u8{0xCB, 0xC6}, false, 16},
+	}
+
+	for _, test := range tests {
+		rom := newBankedRom(0x00 /*ROM ONLY*/, 2, 0x00 /*None*/)
+		copy(rom[0x0100:], test.code)
+		st := newState(rom, nil /*linkCable*/, false /*useWallClock*/)
+		st.biosIsEnabled = false
+		PC.set(st, 0x0100)
+		SP.set(st, 0xFFFE)
+		HL.set(st, 0xC000)
+		F.Z.set(st, test.zero)
+
+		if cycles := fetchDecodeExecute(st); cycles != test.cycles {
+			t.Errorf("%s: expected %d cycles, got %d.", test.name, test.cycles, cycles)
+		}
+	}
+}
+
+func TestMemoryAccessTiming(t *testing.T) {
+	// LDH A,(0x04): The DIV register is read during the third M-cycle.
+	rom := newBankedRom(0x00 /*ROM ONLY*/, 2, 0x00 /*None*/)
+	copy(rom[0x0100:], []u8{0xF0, 0x04})
+	st := newState(rom, nil /*linkCable*/, false /*useWallClock*/)
+	st.biosIsEnabled = false
+	PC.set(st, 0x0100)
+	st.timing.systemClock = 0x00F8
+
+	if cycles := fetchDecodeExecute(st); cycles != 12 {
+		t.Fatalf("Expected 12 cycles, got %d.", cycles)
+	}
+	if A := A.get(st); A != 0x01 {
+		t.Fatalf("Expected DIV to have been read after 12 cycles (0x01), got 0x%02X.", A)
+	}
+	if st.timing.systemClock != 0x0104 {
+		t.Fatalf("Expected the clock to be at 0x0104, got 0x%04X.", st.timing.systemClock)
+	}
+
+	// PUSH BC: The high byte is written first, after an internal delay.
+	rom = newBankedRom(0x00 /*ROM ONLY*/, 2, 0x00 /*None*/)
+	copy(rom[0x0100:], []u8{0xC5})
+	st = newState(rom, nil /*linkCable*/, false /*useWallClock*/)
+	st.biosIsEnabled = false
+	PC.set(st, 0x0100)
+	SP.set(st, 0xC002)
+	BC.set(st, 0x1234)
+	if cycles := fetchDecodeExecute(st); cycles != 16 || st.timing.cycles != 16 {
+		t.Fatalf("Expected 16 cycles, got %d (%d on the clock).", cycles, st.timing.cycles)
+	}
+	expectRead(t, "PUSH high byte", st.readMem(0xC001), 0x12)
+	expectRead(t, "PUSH low byte", st.readMem(0xC000), 0x34)
+}
+
+func TestHalt(t *testing.T) {
+	newHaltState := func(IME bool, IE, IF u8) *st {
+		rom := newBankedRom(0x00 /*ROM ONLY*/, 2, 0x00 /*None*/)
+		copy(rom[0x0100:], []u8{0x76, 0x3C, 0x00}) // HALT, INC A, NOP
+		st := newState(rom, nil /*linkCable*/, false /*useWallClock*/)
+		st.biosIsEnabled = false
+		PC.set(st, 0x0100)
+		A.set(st, 0x00)
+		st.IME = IME
+		st.writeMem(0xFFFF, IE)
+		st.writeMem(0xFF0F, IF)
+		return st
+	}
+
+	st := newHaltState(false, 0x04, 0x00)
+	fetchDecodeExecute(st)
+	if !st.halted {
+		t.Fatalf("Expected the CPU to halt without a pending interrupt.")
+	}
+
+	st = newHaltState(true, 0x04, 0x04)
+	fetchDecodeExecute(st)
+	if !st.halted || st.haltBug {
+		t.Fatalf("Expected the CPU to halt with IME=1.")
+	}
+
+	// The HALT bug: INC A is executed twice.
+	st = newHaltState(false, 0x04, 0x04)
+	fetchDecodeExecute(st)
+	if st.halted {
+		t.Fatalf("Expected the CPU not to halt with a pending interrupt and IME=0.")
+	}
+	fetchDecodeExecute(st)
+	fetchDecodeExecute(st)
+	if A := A.get(st); A != 0x02 {
+		t.Fatalf("Expected INC A to be executed twice, got A=0x%02X.", A)
+	}
+	if pc := PC.get(st); pc != 0x0102 {
+		t.Fatalf("Expected PC=0x0102, got 0x%04X.", pc)
+	}
+}
+
+func TestStop(t *testing.T) {
+	rom := newBankedRom(0x00 /*ROM ONLY*/, 2, 0x00 /*None*/)
+	copy(rom[0x0100:], []u8{0x10, 0x00, 0x3C}) // STOP, INC A
+	st := newState(rom, nil /*linkCable*/, false /*useWallClock*/)
+	st.biosIsEnabled = false
+	PC.set(st, 0x0100)
+	st.writeMem(0xFF00, 0x20) // P1: Select the direction keys.
+	st.writeMem(0xFF40, 0x91) // LCDC: LCD on
+	st.addCycles(0x1000)
+	if DIV := st.readMem(0xFF04); DIV != 0x10 {
+		t.Fatalf("Expected DIV=0x10 before STOP, got 0x%02X.", DIV)
+	}
+
+	st.step()
+	if !st.stopped {
+		t.Fatalf("Expected the system to stop.")
+	}
+	if DIV := st.readMem(0xFF04); DIV != 0x00 {
+		t.Fatalf("Expected DIV to be reset, got 0x%02X.", DIV)
+	}
+	if pc := PC.get(st); pc != 0x0102 {
+		t.Fatalf("Expected the byte after STOP to be skipped, got PC=0x%04X.", pc)
+	}
+
+	// Nothing runs while stopped, not even the LCD.
+	ppu := st.ppu
+	cycles := st.timing.cycles
+	for i := 0; i < 1000; i++ {
+		st.step()
+	}
+	if st.ppu.dot != ppu.dot || st.ppu.ly != ppu.ly || st.timing.cycles != cycles || st.timing.systemClock != 0 {
+		t.Fatalf("Expected the LCD and the timer not to advance while stopped.")
+	}
+	if A := A.get(st); A != 0x00 {
+		t.Fatalf("Expected the CPU not to run while stopped, got A=0x%02X.", A)
+	}
+
+	// A button that isn't selected doesn't wake the system.
+	st.setButtons(0x10) // a
+	if !st.stopped {
+		t.Fatalf("Expected an unselected button not to end the STOP mode.")
+	}
+	st.setButtons(0x11) // a, right
+	if st.stopped {
+		t.Fatalf("Expected a button press to end the STOP mode.")
+	}
+	st.step()
+	if A := A.get(st); A != 0x01 {
+		t.Fatalf("Expected the CPU to run again after the button press, got A=0x%02X.", A)
+	}
+}
+
+func TestSpeedSwitch(t *testing.T) {
+	rom := newBankedRom(0x00 /*ROM ONLY*/, 2, 0x00 /*None*/)
+	rom[0x0143] = 0x80                   // CGB compatible
+	copy(rom[0x0100:], []u8{0x10, 0x00}) // STOP
+	st := newState(rom, nil /*linkCable*/, false /*useWallClock*/)
+	st.biosIsEnabled = false
+	PC.set(st, 0x0100)
+
+	st.writeMem(0xFF4D, 0xFF) // KEY1: Prepare speed switch
+	if KEY1 := st.readMem(0xFF4D); KEY1 != 0x7F {
+		t.Fatalf("Expected KEY1=0x7F before the switch, got 0x%02X.", KEY1)
+	}
+	fetchDecodeExecute(st)
+	if st.stopped || !st.doubleSpeed {
+		t.Fatalf("Expected STOP to switch to double speed.")
+	}
+	if KEY1 := st.readMem(0xFF4D); KEY1 != 0xFE {
+		t.Fatalf("Expected KEY1=0xFE after the switch, got 0x%02X.", KEY1)
+	}
+
+	// The timer runs twice as fast as the rest.
+	cycles := st.timing.cycles
+	st.timing.systemClock = 0x0000
+	st.addCycles(1000)
+	if st.timing.systemClock != 1000 || st.timing.cycles-cycles != 500 {
+		t.Fatalf("Expected 1000 cycles on the timer and 500 on the clock, got %d and %d.",
+			st.timing.systemClock, st.timing.cycles-cycles)
+	}
+
+	// Without the CGB flag, there is no KEY1.
+	rom[0x0143] = 0x00
+	st = newState(rom, nil /*linkCable*/, false /*useWallClock*/)
+	st.biosIsEnabled = false
+	PC.set(st, 0x0100)
+	st.writeMem(0xFF4D, 0x01)
+	if KEY1 := st.readMem(0xFF4D); KEY1 != 0xFF {
+		t.Fatalf("Expected KEY1=0xFF on a DMG cartridge, got 0x%02X.", KEY1)
+	}
+	fetchDecodeExecute(st)
+	if !st.stopped || st.doubleSpeed {
+		t.Fatalf("Expected STOP to stop without switching the speed.")
+	}
+}
@@ -0,0 +1,67 @@
+/*
+ * gammaboy is a Game Boy emulator.
+ * Copyright (C) 2018  gammpei
+ *
+ * This file is part of gammaboy.
+ *
+ * gammaboy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * gammaboy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with gammaboy.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+// An OAM DMA transfer copies 160 bytes to 0xFE00-0xFE9F, one byte every 4 cycles.
+type dma struct {
+	active bool
+	source u16
+	cycles int // The number of cycles since the start of the transfer.
+}
+
+// Started by writing the high byte of the source address to 0xFF46.
+func (st *st) startDma(value u8) {
+	source := u16(value) << 8
+	if source >= 0xE000 {
+		// The upper part of the address space isn't reachable, it reads from the mirror of the work ram instead.
+		source -= 0x2000
+	}
+
+	// Starting a new transfer cancels the current one.
+	st.dma = dma{
+		active: true,
+		source: source,
+		cycles: 0,
+	}
+}
+
+// Advances the DMA transfer by one cycle.
+func (st *st) stepDma() {
+	dma := &st.dma
+	if !dma.active {
+		return
+	}
+
+	dma.cycles++
+	if dma.cycles%4 == 0 {
+		i := u16(dma.cycles/4 - 1)
+		st.mem[0xFE00+i] = st.readBus(dma.source + i)
+		if i == 0x9F {
+			dma.active = false
+		}
+	}
+}
+
+func (dma *dma) sync(s *serializer) {
+	s.bool(&dma.active)
+	s.u16(&dma.source)
+	s.int(&dma.cycles)
+}
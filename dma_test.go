@@ -0,0 +1,85 @@
+/*
+ * gammaboy is a Game Boy emulator.
+ * Copyright (C) 2018  gammpei
+ *
+ * This file is part of gammaboy.
+ *
+ * gammaboy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * gammaboy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with gammaboy.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func newTestDmaState() *st {
+	st := newState(newBankedRom(0x00 /*ROM ONLY*/, 2, 0x00 /*None*/), nil /*linkCable*/, false /*useWallClock*/)
+	for i := u16(0); i < 0xA0; i++ {
+		st.mem[0xC000+i] = u8(i) + 1
+	}
+	return st
+}
+
+func expectOam(t *testing.T, st *st) {
+	for i := u16(0); i < 0xA0; i++ {
+		if actual := st.mem[0xFE00+i]; actual != u8(i)+1 {
+			t.Fatalf(`Expected 0x%02X at 0x%04X, got 0x%02X.`, u8(i)+1, 0xFE00+i, actual)
+		}
+	}
+}
+
+func TestDma(t *testing.T) {
+	st := newTestDmaState()
+	st.writeMem(0xFF46, 0xC0) // DMA: From 0xC000
+
+	st.addCycles(639)
+	if !st.dma.active || st.mem[0xFE9F] != 0x00 {
+		t.Fatalf(`Expected the transfer to still be running after 639 cycles.`)
+	}
+
+	// Only HRAM (and the I/O registers) can be accessed during the transfer.
+	if value := st.readMem(0xC000); value != 0xFF {
+		t.Fatalf(`Expected reads from the work ram to return 0xFF, got 0x%02X.`, value)
+	}
+	st.writeMem(0xC100, 0x42)
+	if st.mem[0xC100] != 0x00 {
+		t.Fatalf(`Expected writes to the work ram to be ignored.`)
+	}
+	st.writeMem(0xFF80, 0x42)
+	if value := st.readMem(0xFF80); value != 0x42 {
+		t.Fatalf(`Expected HRAM to be accessible, got 0x%02X.`, value)
+	}
+
+	st.addCycles(1)
+	if st.dma.active {
+		t.Fatalf(`Expected the transfer to be done after 640 cycles.`)
+	}
+	expectOam(t, st)
+	if value := st.readMem(0xC000); value != 0x01 {
+		t.Fatalf(`Expected the work ram to be accessible again, got 0x%02X.`, value)
+	}
+}
+
+func TestDmaEchoSource(t *testing.T) {
+	st := newTestDmaState()
+	st.writeMem(0xFF46, 0xE0) // DMA: From 0xE000, the mirror of 0xC000
+	st.addCycles(640)
+	expectOam(t, st)
+
+	st.writeMem(0xFF46, 0xFF)
+	if st.dma.source != 0xDF00 {
+		t.Fatalf(`Expected 0xFF00 to be remapped to 0xDF00, got 0x%04X.`, st.dma.source)
+	}
+}
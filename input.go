@@ -0,0 +1,341 @@
+/*
+ * gammaboy is a Game Boy emulator.
+ * Copyright (C) 2018  gammpei
+ *
+ * This file is part of gammaboy.
+ *
+ * gammaboy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * gammaboy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with gammaboy.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/veandco/go-sdl2/sdl"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The keys of each action, by SDL key name.
+// They can be overridden in the key bindings file.
+var defaultKeyBindings = map[string][]string{
+	"right":  {"Right"},
+	"left":   {"Left"},
+	"up":     {"Up"},
+	"down":   {"Down"},
+	"a":      {"X"},
+	"b":      {"Z"},
+	"select": {"Backspace", "Right Shift"},
+	"start":  {"Return"},
+
+	"pause":         {"P"},
+	"frame-advance": {"K"},
+	"fast-forward":  {"Space"},
+	"slow-motion":   {"E"},
+	"rewind":        {"R"},
+
+	"save-state": {"F2"},
+	"load-state": {"F4"},
+	"slot-0":     {"0"},
+	"slot-1":     {"1"},
+	"slot-2":     {"2"},
+	"slot-3":     {"3"},
+	"slot-4":     {"4"},
+	"slot-5":     {"5"},
+	"slot-6":     {"6"},
+	"slot-7":     {"7"},
+	"slot-8":     {"8"},
+	"slot-9":     {"9"},
+}
+
+// ~/.config/gammaboy/keys.txt on Linux.
+func defaultKeyBindingsPath() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(configDir, "gammaboy", "keys.txt")
+}
+
+// The key bindings file has one action per line:
+//
+//	# Comment
+//	a = X
+//	select = Backspace, Right Shift
+//
+// The actions that are not in the file keep their default keys.
+func loadKeyBindings(path string) map[sdl.Keycode]string {
+	actionToKeys := map[string][]string{}
+	for action, keys := range defaultKeyBindings {
+		actionToKeys[action] = keys
+	}
+
+	mustExist := true
+	if path == "" {
+		path = defaultKeyBindingsPath()
+		mustExist = false
+	}
+	if path != "" {
+		file, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) && !mustExist {
+			file = nil
+		} else {
+			check(err)
+		}
+
+		for i, line := range strings.Split(string(file), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			fields := strings.SplitN(line, "=", 2)
+			if len(fields) != 2 {
+				panic(fmt.Sprintf("%s:%d: Expected \"action = key\".", path, i+1))
+			}
+			action := strings.TrimSpace(fields[0])
+			if _, ok := defaultKeyBindings[action]; !ok {
+				panic(fmt.Sprintf("%s:%d: Unknown action %q.", path, i+1, action))
+			}
+			var keys []string
+			for _, key := range strings.Split(fields[1], ",") {
+				keys = append(keys, strings.TrimSpace(key))
+			}
+			actionToKeys[action] = keys
+		}
+	}
+
+	keyToAction := map[sdl.Keycode]string{}
+	for action, keys := range actionToKeys {
+		for _, key := range keys {
+			keycode := sdl.GetKeyFromName(key)
+			if keycode == sdl.K_UNKNOWN {
+				panic(fmt.Sprintf("Unknown key %q for %q.", key, action))
+			}
+			keyToAction[keycode] = action
+		}
+	}
+	return keyToAction
+}
+
+// The joypad bit of an action, or -1 if it isn't a button.
+func buttonBit(action string) int {
+	for i, name := range buttonNames {
+		if name == action {
+			return i
+		}
+	}
+	return -1
+}
+
+func (gui *gui) hotkey(action string, pressed bool) {
+	switch action {
+	case "pause":
+		if pressed {
+			gui.paused = !gui.paused
+		}
+	case "frame-advance":
+		if pressed {
+			gui.paused = true
+			gui.frameAdvance = true
+		}
+	case "fast-forward":
+		gui.fastForward = pressed
+	case "slow-motion":
+		if pressed {
+			gui.slowMotion = !gui.slowMotion
+		}
+	case "rewind":
+		gui.rewinding = pressed
+	case "save-state":
+		gui.saveStateRequested = gui.saveStateRequested || pressed
+	case "load-state":
+		gui.loadStateRequested = gui.loadStateRequested || pressed
+	default:
+		var slot int
+		if _, err := fmt.Sscanf(action, "slot-%d", &slot); err == nil && pressed {
+			gui.stateSlot = slot
+			fmt.Printf("Save state slot %d\n", slot)
+		}
+	}
+	gui.updateTitle()
+}
+
+// A multiple of the Game Boy speed, 0 means uncapped.
+func (gui *gui) speed() float64 {
+	switch {
+	case gui.fastForward:
+		return flags.fastForward
+	case gui.slowMotion:
+		return flags.slowMotion
+	default:
+		return 1
+	}
+}
+
+func (gui *gui) updateTitle() {
+	title := gui.title
+	switch speed := gui.speed(); {
+	case gui.paused:
+		title += " [paused]"
+	case speed == 0:
+		title += " [fast-forward]"
+	case speed != 1:
+		title += fmt.Sprintf(" [x%g]", speed)
+	}
+	gui.window.SetTitle(title)
+}
+
+// Processes the events until we are unpaused or asked to advance one frame.
+// Returns false if the window was closed.
+func (gui *gui) waitWhilePaused() bool {
+	for gui.paused && !gui.frameAdvance {
+		time.Sleep(framePeriod)
+		if !gui.processEvents() {
+			return false
+		}
+	}
+	gui.frameAdvance = false
+	return true
+}
+
+// After a STOP, nothing runs until a button is pressed.
+// Returns false if the window was closed.
+func (gui *gui) waitWhileStopped(st *st) bool {
+	for st.stopped {
+		time.Sleep(framePeriod)
+		if !gui.processEvents() {
+			return false
+		}
+		st.setButtons(gui.joypadButtons())
+	}
+	return true
+}
+
+// A game controller and the joypad buttons it holds down.
+type controller struct {
+	gameController *sdl.GameController
+	buttons        u8 // From the buttons and the D-pad.
+	stick          u8 // From the left analog stick.
+}
+
+var controllerButtons = map[uint8]string{
+	sdl.CONTROLLER_BUTTON_DPAD_RIGHT: "right",
+	sdl.CONTROLLER_BUTTON_DPAD_LEFT:  "left",
+	sdl.CONTROLLER_BUTTON_DPAD_UP:    "up",
+	sdl.CONTROLLER_BUTTON_DPAD_DOWN:  "down",
+	sdl.CONTROLLER_BUTTON_A:          "a",
+	sdl.CONTROLLER_BUTTON_B:          "b",
+	sdl.CONTROLLER_BUTTON_BACK:       "select",
+	sdl.CONTROLLER_BUTTON_START:      "start",
+}
+
+// The analog stick has to be pushed halfway to press a direction.
+const stickDeadZone = 0x4000
+
+// SDL sends an added event for each controller that is already connected at startup.
+func (gui *gui) addController(index int) {
+	if !sdl.IsGameController(index) {
+		return
+	}
+	gameController := sdl.GameControllerOpen(index)
+	if gameController == nil {
+		return
+	}
+
+	id := gameController.Joystick().InstanceID()
+	if _, ok := gui.controllers[id]; ok {
+		gameController.Close()
+		return
+	}
+
+	fmt.Printf("Controller connected: %s\n", gameController.Name())
+	controller := &controller{
+		gameController: gameController,
+		buttons:        0x00,
+		stick:          0x00,
+	}
+	gui.controllers[id] = controller
+	controller.rumble(gui.motor)
+}
+
+func (gui *gui) removeController(id sdl.JoystickID) {
+	controller, ok := gui.controllers[id]
+	if !ok {
+		return
+	}
+
+	fmt.Printf("Controller disconnected: %s\n", controller.gameController.Name())
+	controller.gameController.Close()
+	delete(gui.controllers, id)
+}
+
+// SDL stops the rumble after a while, in case the motor is never turned off (pause, crash...).
+// While the motor is on, the rumble is requested again every frame.
+const rumbleDuration = 1000 // ms
+
+func (gui *gui) setMotor(motor bool) {
+	gui.motor = motor
+	gui.rumble()
+}
+
+// Sends the motor to the controllers.
+func (gui *gui) rumble() {
+	for _, controller := range gui.controllers {
+		controller.rumble(gui.motor)
+	}
+}
+
+func (controller *controller) rumble(motor bool) {
+	if motor {
+		controller.gameController.Rumble(0xFFFF, 0xFFFF, rumbleDuration)
+	} else {
+		controller.gameController.Rumble(0x0000, 0x0000, 0)
+	}
+}
+
+func (controller *controller) setButton(button uint8, pressed bool) {
+	action, ok := controllerButtons[button]
+	if !ok {
+		return
+	}
+	controller.buttons = setBit(controller.buttons, uint(buttonBit(action)), pressed)
+}
+
+func (controller *controller) setAxis(axis uint8, value int16) {
+	set := func(action string, pressed bool) {
+		controller.stick = setBit(controller.stick, uint(buttonBit(action)), pressed)
+	}
+
+	switch axis {
+	case sdl.CONTROLLER_AXIS_LEFTX:
+		set("left", value < -stickDeadZone)
+		set("right", value > stickDeadZone)
+	case sdl.CONTROLLER_AXIS_LEFTY:
+		set("up", value < -stickDeadZone)
+		set("down", value > stickDeadZone)
+	}
+}
+
+// The buttons held down on the keyboard or on any controller.
+func (gui *gui) joypadButtons() u8 {
+	buttons := gui.keyboardButtons
+	for _, controller := range gui.controllers {
+		buttons |= controller.buttons | controller.stick
+	}
+	return buttons
+}
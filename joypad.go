@@ -0,0 +1,72 @@
+/*
+ * gammaboy is a Game Boy emulator.
+ * Copyright (C) 2018  gammpei
+ *
+ * This file is part of gammaboy.
+ *
+ * gammaboy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * gammaboy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with gammaboy.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+// The bits of st.buttons, 1 means pressed.
+// The lower 4 bits are read through P14, the upper 4 bits through P15.
+var buttonNames = [8]string{
+	"right",  // P10 with P14
+	"left",   // P11 with P14
+	"up",     // P12 with P14
+	"down",   // P13 with P14
+	"a",      // P10 with P15
+	"b",      // P11 with P15
+	"select", // P12 with P15
+	"start",  // P13 with P15
+}
+
+// P1: Joypad
+func (st *st) readJoypad() u8 {
+	P1 := st.mem[0xFF00]&0x30 | 0xC0 // Bits 6 and 7 are unused.
+
+	// The input lines are low when a selected button is pressed.
+	lines := u8(0x0F)
+	if !getBit(P1, 4) { // P14: Select the direction keys.
+		lines &^= st.buttons & 0x0F
+	}
+	if !getBit(P1, 5) { // P15: Select the button keys.
+		lines &^= st.buttons >> 4
+	}
+	return P1 | lines
+}
+
+func (st *st) writeJoypad(value u8) {
+	before := st.readJoypad()
+	// Only the select lines are writable.
+	st.mem[0xFF00] = value & 0x30
+	st.checkJoypadInterrupt(before)
+}
+
+func (st *st) setButtons(pressed u8) {
+	before := st.readJoypad()
+	st.buttons = pressed
+	st.checkJoypadInterrupt(before)
+}
+
+// The joypad interrupt is requested when an input line goes from high to low.
+// This also ends the STOP mode.
+func (st *st) checkJoypadInterrupt(before u8) {
+	after := st.readJoypad()
+	if before&^after&0x0F != 0x00 {
+		st.requestInterrupt(4) // Request joypad interrupt.
+		st.stopped = false
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ * gammaboy is a Game Boy emulator.
+ * Copyright (C) 2018  gammpei
+ *
+ * This file is part of gammaboy.
+ *
+ * gammaboy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * gammaboy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with gammaboy.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestJoypadSelection(t *testing.T) {
+	st := newState(newBankedRom(0x00 /*ROM ONLY*/, 2, 0x00 /*None*/), nil /*linkCable*/, false /*useWallClock*/)
+	st.setButtons(0x81) // start, right
+
+	for _, c := range []struct {
+		P1       u8
+		expected u8
+	}{
+		{0x30, 0xFF}, // Nothing selected
+		{0x20, 0xEE}, // P14: The direction keys
+		{0x10, 0xD7}, // P15: The button keys
+		{0x00, 0xC6}, // Both
+	} {
+		st.writeMem(0xFF00, c.P1)
+		if actual := st.readMem(0xFF00); actual != c.expected {
+			t.Fatalf(`P1=0x%02X: expected 0x%02X, got 0x%02X.`, c.P1, c.expected, actual)
+		}
+	}
+}
+
+func TestJoypadInterrupt(t *testing.T) {
+	st := newState(newBankedRom(0x00 /*ROM ONLY*/, 2, 0x00 /*None*/), nil /*linkCable*/, false /*useWallClock*/)
+	expectInterrupt := func(expected bool, context string) {
+		if actual := getBit(st.readMem(0xFF0F), 4); actual != expected {
+			t.Fatalf(`%s: expected the joypad interrupt to be %v.`, context, expected)
+		}
+		st.writeMem(0xFF0F, 0x00)
+	}
+
+	st.writeMem(0xFF00, 0x20) // P14: The direction keys
+	st.setButtons(0x10)       // a
+	expectInterrupt(false, "unselected button")
+	st.setButtons(0x11) // a, right
+	expectInterrupt(true, "pressed")
+	st.setButtons(0x11)
+	expectInterrupt(false, "held")
+	st.setButtons(0x10)
+	expectInterrupt(false, "released")
+
+	// Selecting a group with a pressed button also pulls a line low.
+	st.writeMem(0xFF00, 0x00)
+	expectInterrupt(true, "selected")
+	st.writeMem(0xFF00, 0x30)
+	expectInterrupt(false, "deselected")
+}
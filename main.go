@@ -24,35 +24,60 @@ import (
 	cmdLineFlag "flag"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"sync"
 	"time"
 )
 
 var bios [256]u8
+var biosOnce sync.Once
 var jumpTable [256]*instr
 var extendedJumpTable [256]*instr
 
 var flags struct {
-	green      bool
-	record     bool
-	scalingAlg string
-	verbose    bool
+	audioOut    string
+	fastForward float64
+	green       bool
+	keys        string
+	record      bool
+	rewindMb    int
+	rtc         string
+	scalingAlg  string
+	slowMotion  float64
+	verbose     bool
 }
 
 func init() {
-	loadBios()
 	buildJumpTables()
 }
 
 func main() {
+	cmdLineFlag.StringVar(&flags.audioOut, "audio-out", "", "Write the audio to a WAV file.")
+	cmdLineFlag.Float64Var(&flags.fastForward, "fast-forward", 0,
+		"Speed multiplier while fast-forwarding, 0 for uncapped.")
 	cmdLineFlag.BoolVar(&flags.green, "green", false, "Use a green palette instead of grayscale.")
+	cmdLineFlag.StringVar(&flags.keys, "keys", "",
+		"Key bindings file (default: keys.txt in the gammaboy user config directory).")
 	cmdLineFlag.BoolVar(&flags.record, "record", false, "Create a video recording.")
+	cmdLineFlag.IntVar(&flags.rewindMb, "rewind-mb", 64, "Memory for the rewind buffer in MiB, 0 to disable it.")
+	cmdLineFlag.StringVar(&flags.rtc, "rtc", "wall",
+		"Clock source of the cartridge real-time clock: wall or emulated.")
 	cmdLineFlag.StringVar(&flags.scalingAlg, "scaling-alg", "0",
 		"Scaling algorithm: 0 or nearest, 1 or linear.")
+	cmdLineFlag.Float64Var(&flags.slowMotion, "slow-motion", 0.5, "Speed multiplier in slow motion.")
 	cmdLineFlag.BoolVar(&flags.verbose, "verbose", false, "Print every instruction (very slow).")
 	cmdLineFlag.Parse()
+	assert(flags.rtc == "wall" || flags.rtc == "emulated")
+	assert(flags.fastForward >= 0 && flags.slowMotion > 0 && flags.rewindMb >= 0)
 
 	args := cmdLineFlag.Args()
+	if len(args) >= 1 && args[0] == "info" {
+		info(args[1:])
+		return
+	}
+
 	var rom []u8
+	var romPath string
 	var title string
 	switch len(args) {
 	case 0:
@@ -60,10 +85,12 @@ func main() {
 		for i, _ := range rom {
 			rom[i] = 0xFF
 		}
+		rom[0x0147] = 0x00 // Cartridge type: ROM ONLY
+		rom[0x0149] = 0x00 // RAM size: None
 
 		title = "gammaboy"
 	case 1:
-		romPath := args[0]
+		romPath = args[0]
 		startLoadRom := time.Now()
 		var err error
 		rom, err = ioutil.ReadFile(romPath)
@@ -76,19 +103,53 @@ func main() {
 		assert(false)
 	}
 
-	gb := newGameBoy(rom, true /*showGui*/, title)
+	gb := newGameBoy(rom, romPath, true /*showGui*/, title)
 	defer gb.close()
 
 	defer stopWatch("main loop", time.Now())
 	gb.run()
 }
 
+// gammaboy info [-json] rom.gb
+// Prints the cartridge header without starting the emulator.
+func info(args []string) {
+	infoFlags := cmdLineFlag.NewFlagSet("info", cmdLineFlag.ExitOnError)
+	jsonOutput := infoFlags.Bool("json", false, "Print the header as JSON.")
+	infoFlags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gammaboy info [-json] rom.gb")
+		infoFlags.PrintDefaults()
+	}
+	infoFlags.Parse(args)
+	// The flags have to come before the rom.
+	if infoFlags.NArg() != 1 {
+		infoFlags.Usage()
+		os.Exit(2)
+	}
+
+	rom, err := ioutil.ReadFile(infoFlags.Arg(0))
+	check(err)
+
+	header := parseCartridgeHeader(rom)
+	if *jsonOutput {
+		header.printJson()
+	} else {
+		header.print()
+	}
+}
+
 type gameBoy struct {
-	st  *st
-	gui *gui
+	st       *st
+	gui      *gui
+	romPath  string // Can be empty.
+	saveFile *saveFile
+	audioOut *wavWriter
+	rewind   *rewindBuffer // Only with the gui.
 }
 
-func newGameBoy(rom []u8, showGui bool, title string) *gameBoy {
+// romPath is used to find the save file, it can be empty.
+func newGameBoy(rom []u8, romPath string, showGui bool, title string) *gameBoy {
+	biosOnce.Do(loadBios)
+
 	var linkCable chan u8 = nil
 	var gui *gui = nil
 	if showGui {
@@ -97,78 +158,176 @@ func newGameBoy(rom []u8, showGui bool, title string) *gameBoy {
 		linkCable = make(chan u8, 80)
 	}
 
+	// Headless runs always use the emulated time so that they are deterministic.
+	useWallClock := showGui && flags.rtc == "wall"
+
+	st := newState(rom, linkCable, useWallClock)
+	if gui != nil {
+		st.rumble = gui.setMotor
+	}
+
+	var saveFile *saveFile = nil
+	if romPath != "" && hasBattery(rom[0x0147]) {
+		saveFile = newSaveFile(savePath(romPath), st.mbc)
+	}
+
+	var audioOut *wavWriter = nil
+	if flags.audioOut != "" {
+		audioOut = newWavWriter(flags.audioOut)
+	}
+
+	var rewind *rewindBuffer = nil
+	if showGui && flags.rewindMb > 0 {
+		rewind = newRewindBuffer(flags.rewindMb * 1024 * 1024)
+	}
+
 	return &gameBoy{
-		st:  newState(rom, linkCable),
-		gui: gui,
+		st:       st,
+		gui:      gui,
+		romPath:  romPath,
+		saveFile: saveFile,
+		audioOut: audioOut,
+		rewind:   rewind,
 	}
 }
 
 func newTestGameBoy(rom []u8) *gameBoy {
-	return newGameBoy(rom, false /*showGui*/, "" /*title*/)
+	return newGameBoy(rom, "" /*romPath*/, false /*showGui*/, "" /*title*/)
 }
 
 func (gb *gameBoy) run() {
 	st := gb.st
 	gui := gb.gui
 
-	curScanline := getScanline(st)
-	for {
+	for frame := 0; ; frame++ {
+		// Flush the save file every 5 seconds or so.
+		if gb.saveFile != nil && frame%300 == 0 {
+			gb.saveFile.flush()
+		}
+
+		samples := st.takeAudioSamples()
+		if gb.audioOut != nil {
+			gb.audioOut.write(samples)
+		}
+
 		if gui != nil {
-			// Draw the whole frame at once (good enough for now).
+			gui.limiter.wait(gui.speed())
 			gui.drawFrame(st)
+			gui.playAudio(samples)
+			if gui.motor {
+				gui.rumble()
+			}
 
 			// Process the events once per frame (good enough for now).
 			if !gui.processEvents() {
 				break
 			}
+			if !gui.waitWhilePaused() {
+				break
+			}
+			if gui.saveStateRequested {
+				gui.saveStateRequested = false
+				gb.saveStateSlot(gui.stateSlot)
+			}
+			if gui.loadStateRequested {
+				gui.loadStateRequested = false
+				gb.loadStateSlot(gui.stateSlot)
+			}
+			st.setButtons(gui.joypadButtons())
+			if !gui.waitWhileStopped(st) {
+				break
+			}
+
+			// While rewinding, we show the previous frames instead of running.
+			gui.rewound = false
+			if gui.rewinding && gb.rewind != nil {
+				if gb.rewind.pop(st) {
+					gui.rewound = true
+					if gui.recorder != nil {
+						gui.recorder.removeLastFrame()
+					}
+				}
+				continue
+			}
+		}
+
+		if gb.rewind != nil {
+			gb.rewind.push(st)
 		}
 
 		// Execute instructions until we need to draw a frame.
 		for {
-			prevScanline := curScanline
-
-			// We assume that all instructions take 4 cycles to execute (good enough for now).
-			fetchDecodeExecute(st)
-			st.addCycles(4)
-
-			// V-Blank.
-			curScanline = getScanline(st)
-			IF := st.readMem(0xFF0F) // IF: Interrupt Flag
-			if prevScanline < 144 && curScanline >= 144 {
-				// Request V-Blank interrupt.
-				IF = st.requestInterrupt(0)
-			}
-
-			// Handle interrupts.
-			IE := st.readMem(0xFFFF) // IE: Interrupt Enable
-			for i := uint(0); i <= 4; i++ {
-				if getBit(IF, i) && getBit(IE, i) {
-					if st.IME {
-						// Disable interrupts.
-						st.IME = false
-
-						// Acknowledge interrupt.
-						IF = setBit(IF, i, false)
-						st.writeMem(0xFF0F, IF)
-
-						// Call interrupt handler.
-						PUSH.f.(func(*state, r_u16))(st, PC)
-						interruptVector := [5]u16{0x0040, 0x0048, 0x0050, 0x0058, 0x0060}
-						PC.set(st, interruptVector[i])
-					}
-					break
+			if st.stopped {
+				if gui == nil {
+					// Nothing can press a button in headless runs, the rom would never go on.
+					panic(fmt.Sprintf("STOP in a headless run at PC=0x%04X.", PC.get(st)-2))
 				}
+				// We draw what we have and wait for a button.
+				break
 			}
 
-			// If the scanline wraps around, we break and draw a frame.
-			if curScanline < prevScanline {
+			st.step()
+
+			// If the PPU finished a frame, we break and draw it.
+			if st.ppu.frameReady {
+				st.ppu.frameReady = false
 				break
 			}
 		}
 	}
 }
 
+// Executes one instruction (or idles while halted), then handles the interrupts.
+// Nothing runs while stopped.
+func (st *st) step() {
+	if st.stopped {
+		return
+	}
+
+	if st.halted {
+		// The CPU idles until an interrupt is pending, even if the interrupts are disabled.
+		st.addCycles(4)
+		IF := st.readMem(0xFF0F) // IF: Interrupt Flag
+		IE := st.readMem(0xFFFF) // IE: Interrupt Enable
+		if IF&IE&0x1F != 0x00 {
+			st.halted = false
+		}
+	} else {
+		fetchDecodeExecute(st)
+	}
+
+	// Handle interrupts.
+	IF := st.readMem(0xFF0F) // IF: Interrupt Flag
+	IE := st.readMem(0xFFFF) // IE: Interrupt Enable
+	for i := uint(0); i <= 4; i++ {
+		if getBit(IF, i) && getBit(IE, i) {
+			if st.IME {
+				// Disable interrupts.
+				st.IME = false
+
+				// Acknowledge interrupt.
+				IF = setBit(IF, i, false)
+				st.writeMem(0xFF0F, IF)
+
+				// Call interrupt handler.
+				// 2 wait states, then the push (12 cycles) and the jump.
+				st.addCycles(8)
+				PUSH.f.(func(*state, r_u16))(st, PC)
+				interruptVector := [5]u16{0x0040, 0x0048, 0x0050, 0x0058, 0x0060}
+				PC.set(st, interruptVector[i])
+			}
+			break
+		}
+	}
+}
+
 func (gb *gameBoy) close() {
+	if gb.saveFile != nil {
+		gb.saveFile.flush()
+	}
+	if gb.audioOut != nil {
+		gb.audioOut.close()
+	}
 	if gb.gui != nil {
 		gb.gui.close()
 	}
@@ -0,0 +1,539 @@
+/*
+ * gammaboy is a Game Boy emulator.
+ * Copyright (C) 2018  gammpei
+ *
+ * This file is part of gammaboy.
+ *
+ * gammaboy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * gammaboy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with gammaboy.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// A Memory Bank Controller maps the rom and the external ram of the cartridge
+// into the address space.
+type mbc interface {
+	readRom(addr u16) u8         // 0x0000-0x7FFF
+	writeRom(addr u16, value u8) // 0x0000-0x7FFF (the MBC registers)
+	readRam(addr u16) u8         // 0xA000-0xBFFF
+	writeRam(addr u16, value u8) // 0xA000-0xBFFF
+
+	// The content of the external ram (and of the RTC) in the .sav file format.
+	// The timestamp goes into the RTC footer, noTimestamp leaves out the running RTC counters (with the wall time).
+	saveData(timestamp time.Time) []u8
+	loadSaveData(data []u8)
+
+	// For the save states, the rom isn't included.
+	sync(s *serializer)
+}
+
+// Whether the external ram (and the RTC) of a cartridge type is battery-backed.
+func hasBattery(cartridgeType u8) bool {
+	switch cartridgeType {
+	case 0x03: // MBC1+RAM+BATTERY
+	case 0x06: // MBC2+BATTERY
+	case 0x09: // ROM+RAM+BATTERY
+	case 0x0F: // MBC3+TIMER+BATTERY
+	case 0x10: // MBC3+TIMER+RAM+BATTERY
+	case 0x13: // MBC3+RAM+BATTERY
+	case 0x1B: // MBC5+RAM+BATTERY
+	case 0x1E: // MBC5+RUMBLE+RAM+BATTERY
+	default:
+		return false
+	}
+	return true
+}
+
+// Called when the motor of a rumble cartridge turns on or off.
+type rumbleHook func(motor bool)
+
+// rumble is only used by rumble cartridges.
+func newMbc(rom []u8, clock rtcClock, rumble rumbleHook) mbc {
+	assert(len(rom) >= 0x8000)
+
+	ram := make([]u8, ramSize(rom[0x0149]))
+
+	cartridgeType := rom[0x0147]
+	switch cartridgeType {
+	case 0x00, 0x08, 0x09: // ROM ONLY, ROM+RAM, ROM+RAM+BATTERY
+		return &romOnly{rom, ram}
+	case 0x01, 0x02, 0x03: // MBC1, MBC1+RAM, MBC1+RAM+BATTERY
+		return &mbc1{
+			rom:       rom,
+			ram:       ram,
+			ramEnable: false,
+			bank1:     0x01,
+			bank2:     0x00,
+			mode:      false,
+		}
+	case 0x05, 0x06: // MBC2, MBC2+BATTERY
+		return &mbc2{
+			rom: rom,
+			// The header says there is no ram since it's built into the MBC2.
+			ram:       make([]u8, 512),
+			ramEnable: false,
+			romBank:   0x01,
+		}
+	case 0x0F, 0x10: // MBC3+TIMER+BATTERY, MBC3+TIMER+RAM+BATTERY
+		return &mbc3{
+			rom:       rom,
+			ram:       ram,
+			rtc:       newRtc(clock),
+			ramEnable: false,
+			romBank:   0x01,
+			ramBank:   0x00,
+		}
+	case 0x11, 0x12, 0x13: // MBC3, MBC3+RAM, MBC3+RAM+BATTERY
+		return &mbc3{
+			rom:       rom,
+			ram:       ram,
+			rtc:       nil,
+			ramEnable: false,
+			romBank:   0x01,
+			ramBank:   0x00,
+		}
+	case 0x19, 0x1A, 0x1B: // MBC5, MBC5+RAM, MBC5+RAM+BATTERY
+		return &mbc5{
+			rom:       rom,
+			ram:       ram,
+			rumble:    nil,
+			ramEnable: false,
+			romBank:   0x001,
+			ramBank:   0x00,
+			motor:     false,
+		}
+	case 0x1C, 0x1D, 0x1E: // MBC5+RUMBLE, MBC5+RUMBLE+RAM, MBC5+RUMBLE+RAM+BATTERY
+		assert(rumble != nil)
+		return &mbc5{
+			rom:       rom,
+			ram:       ram,
+			rumble:    rumble,
+			ramEnable: false,
+			romBank:   0x001,
+			ramBank:   0x00,
+			motor:     false,
+		}
+	default:
+		panic(fmt.Sprintf("Unsupported cartridge type 0x%02X.", cartridgeType))
+	}
+}
+
+// The size of the external ram from the header byte at 0x0149.
+func ramSize(x u8) int {
+	switch x {
+	case 0x00:
+		return 0
+	case 0x01:
+		return 2 * 1024
+	case 0x02:
+		return 8 * 1024
+	case 0x03:
+		return 32 * 1024 // 4 banks of 8KB
+	case 0x04:
+		return 128 * 1024 // 16 banks of 8KB
+	case 0x05:
+		return 64 * 1024 // 8 banks of 8KB
+	default:
+		panic(fmt.Sprintf("Invalid ram size 0x%02X.", x))
+	}
+}
+
+func copyRam(ram []u8) []u8 {
+	return append([]u8(nil), ram...)
+}
+
+// The size of the save file can differ from the ram if it was written by another emulator.
+func loadRam(ram []u8, data []u8) {
+	if len(data) != len(ram) {
+		fmt.Printf("Expected %d bytes of save data, got %d.\n", len(ram), len(data))
+	}
+	copy(ram, data)
+}
+
+// The index in the rom of addr for a given 16KB bank.
+// Bank numbers wrap around when they exceed the size of the rom.
+func romIndex(rom []u8, bank int, addr u16) int {
+	nbBanks := len(rom) / 0x4000
+	return (bank%nbBanks)*0x4000 + int(addr&0x3FFF)
+}
+
+// The index in the ram of addr for a given 8KB bank.
+// Small rams (2KB) are mirrored across the bank.
+func ramIndex(ram []u8, bank int, addr u16) int {
+	return (bank*0x2000 + int(addr&0x1FFF)) % len(ram)
+}
+
+// --------
+// ROM ONLY
+// --------
+
+type romOnly struct {
+	rom []u8
+	ram []u8
+}
+
+func (m *romOnly) readRom(addr u16) u8 {
+	return m.rom[addr]
+}
+
+func (m *romOnly) writeRom(addr u16, value u8) {}
+
+func (m *romOnly) readRam(addr u16) u8 {
+	if len(m.ram) == 0 {
+		return 0xFF
+	}
+	return m.ram[ramIndex(m.ram, 0, addr)]
+}
+
+func (m *romOnly) writeRam(addr u16, value u8) {
+	if len(m.ram) != 0 {
+		m.ram[ramIndex(m.ram, 0, addr)] = value
+	}
+}
+
+func (m *romOnly) saveData(timestamp time.Time) []u8 {
+	return copyRam(m.ram)
+}
+
+func (m *romOnly) loadSaveData(data []u8) {
+	loadRam(m.ram, data)
+}
+
+func (m *romOnly) sync(s *serializer) {
+	s.bytes(m.ram)
+}
+
+// ----
+// MBC1
+// ----
+
+type mbc1 struct {
+	rom []u8
+	ram []u8
+
+	ramEnable bool // 0x0000-0x1FFF
+	bank1     u8   // 0x2000-0x3FFF: The lower 5 bits of the rom bank number.
+	bank2     u8   // 0x4000-0x5FFF: The upper 2 bits of the rom bank number or the ram bank number.
+	mode      bool // 0x6000-0x7FFF: Banking mode select.
+}
+
+func (m *mbc1) readRom(addr u16) u8 {
+	var bank int
+	if addr <= 0x3FFF {
+		// In mode 1, bank2 also applies to the 0x0000-0x3FFF area.
+		if m.mode {
+			bank = int(m.bank2) << 5
+		}
+	} else {
+		bank = int(m.bank2)<<5 | int(m.bank1)
+	}
+	return m.rom[romIndex(m.rom, bank, addr)]
+}
+
+func (m *mbc1) writeRom(addr u16, value u8) {
+	switch {
+	case addr <= 0x1FFF: // RAM Enable
+		m.ramEnable = value&0x0F == 0x0A
+	case addr <= 0x3FFF: // ROM Bank Number
+		m.bank1 = value & 0x1F
+		if m.bank1 == 0x00 {
+			// Bank 0 can't be selected, bank 1 is used instead.
+			m.bank1 = 0x01
+		}
+	case addr <= 0x5FFF: // RAM Bank Number - or - Upper Bits of ROM Bank Number
+		m.bank2 = value & 0x03
+	default: // Banking Mode Select
+		m.mode = getBit(value, 0)
+	}
+}
+
+func (m *mbc1) ramBank() int {
+	if m.mode {
+		return int(m.bank2)
+	}
+	return 0
+}
+
+func (m *mbc1) readRam(addr u16) u8 {
+	if !m.ramEnable || len(m.ram) == 0 {
+		return 0xFF
+	}
+	return m.ram[ramIndex(m.ram, m.ramBank(), addr)]
+}
+
+func (m *mbc1) writeRam(addr u16, value u8) {
+	if m.ramEnable && len(m.ram) != 0 {
+		m.ram[ramIndex(m.ram, m.ramBank(), addr)] = value
+	}
+}
+
+func (m *mbc1) saveData(timestamp time.Time) []u8 {
+	return copyRam(m.ram)
+}
+
+func (m *mbc1) loadSaveData(data []u8) {
+	loadRam(m.ram, data)
+}
+
+func (m *mbc1) sync(s *serializer) {
+	s.bytes(m.ram)
+	s.bool(&m.ramEnable)
+	s.u8(&m.bank1)
+	s.u8(&m.bank2)
+	s.bool(&m.mode)
+}
+
+// ----
+// MBC2
+// ----
+
+type mbc2 struct {
+	rom []u8
+	ram []u8 // 512 x 4 bits, only the lower 4 bits of each byte are used.
+
+	ramEnable bool
+	romBank   u8
+}
+
+func (m *mbc2) readRom(addr u16) u8 {
+	var bank int
+	if addr >= 0x4000 {
+		bank = int(m.romBank)
+	}
+	return m.rom[romIndex(m.rom, bank, addr)]
+}
+
+func (m *mbc2) writeRom(addr u16, value u8) {
+	if addr >= 0x4000 {
+		return
+	}
+
+	// Bit 8 of the address selects the register in 0x0000-0x3FFF.
+	if !getBit_u16(addr, 8) { // RAM Enable
+		m.ramEnable = value&0x0F == 0x0A
+	} else { // ROM Bank Number
+		m.romBank = value & 0x0F
+		if m.romBank == 0x00 {
+			m.romBank = 0x01
+		}
+	}
+}
+
+func (m *mbc2) readRam(addr u16) u8 {
+	if !m.ramEnable {
+		return 0xFF
+	}
+	// The ram is mirrored across 0xA000-0xBFFF and the upper 4 bits read as 1s.
+	return m.ram[addr&0x01FF] | 0xF0
+}
+
+func (m *mbc2) writeRam(addr u16, value u8) {
+	if m.ramEnable {
+		m.ram[addr&0x01FF] = value & 0x0F
+	}
+}
+
+func (m *mbc2) saveData(timestamp time.Time) []u8 {
+	return copyRam(m.ram)
+}
+
+func (m *mbc2) loadSaveData(data []u8) {
+	loadRam(m.ram, data)
+}
+
+func (m *mbc2) sync(s *serializer) {
+	s.bytes(m.ram)
+	s.bool(&m.ramEnable)
+	s.u8(&m.romBank)
+}
+
+// ----
+// MBC3
+// ----
+
+type mbc3 struct {
+	rom []u8
+	ram []u8
+	rtc *rtc // nil if the cartridge has no timer.
+
+	ramEnable bool // 0x0000-0x1FFF: RAM and Timer Enable
+	romBank   u8   // 0x2000-0x3FFF
+	ramBank   u8   // 0x4000-0x5FFF: The ram bank (0x00-0x07) or the RTC register (0x08-0x0C).
+}
+
+func (m *mbc3) readRom(addr u16) u8 {
+	var bank int
+	if addr >= 0x4000 {
+		bank = int(m.romBank)
+	}
+	return m.rom[romIndex(m.rom, bank, addr)]
+}
+
+func (m *mbc3) writeRom(addr u16, value u8) {
+	switch {
+	case addr <= 0x1FFF: // RAM and Timer Enable
+		m.ramEnable = value&0x0F == 0x0A
+	case addr <= 0x3FFF: // ROM Bank Number
+		m.romBank = value & 0x7F
+		if m.romBank == 0x00 {
+			m.romBank = 0x01
+		}
+	case addr <= 0x5FFF: // RAM Bank Number - or - RTC Register Select
+		m.ramBank = value & 0x0F
+	default: // Latch Clock Data
+		if m.rtc != nil {
+			m.rtc.writeLatch(value)
+		}
+	}
+}
+
+func (m *mbc3) readRam(addr u16) u8 {
+	switch {
+	case !m.ramEnable:
+		return 0xFF
+	case m.ramBank <= 0x07 && len(m.ram) != 0:
+		return m.ram[ramIndex(m.ram, int(m.ramBank), addr)]
+	case 0x08 <= m.ramBank && m.ramBank <= 0x0C && m.rtc != nil:
+		return m.rtc.read(m.ramBank)
+	default:
+		return 0xFF
+	}
+}
+
+func (m *mbc3) writeRam(addr u16, value u8) {
+	switch {
+	case !m.ramEnable:
+	case m.ramBank <= 0x07 && len(m.ram) != 0:
+		m.ram[ramIndex(m.ram, int(m.ramBank), addr)] = value
+	case 0x08 <= m.ramBank && m.ramBank <= 0x0C && m.rtc != nil:
+		m.rtc.write(m.ramBank, value)
+	}
+}
+
+func (m *mbc3) saveData(timestamp time.Time) []u8 {
+	data := copyRam(m.ram)
+	if m.rtc != nil {
+		data = append(data, m.rtc.saveData(timestamp)...)
+	}
+	return data
+}
+
+func (m *mbc3) loadSaveData(data []u8) {
+	footerSize := len(data) - len(m.ram)
+	if m.rtc != nil && (footerSize == rtcSaveDataSize || footerSize == rtcSaveDataSize-4) {
+		// Saves without a footer leave the RTC as it is.
+		m.rtc.loadSaveData(data[len(m.ram):])
+		data = data[:len(m.ram)]
+	}
+	loadRam(m.ram, data)
+}
+
+func (m *mbc3) sync(s *serializer) {
+	s.bytes(m.ram)
+	s.bool(&m.ramEnable)
+	s.u8(&m.romBank)
+	s.u8(&m.ramBank)
+	if m.rtc != nil {
+		m.rtc.sync(s)
+	}
+}
+
+// ----
+// MBC5
+// ----
+
+type mbc5 struct {
+	rom    []u8
+	ram    []u8
+	rumble rumbleHook // nil if the cartridge has no rumble motor.
+
+	ramEnable bool // 0x0000-0x1FFF
+	romBank   u16  // 0x2000-0x2FFF: The lower 8 bits, 0x3000-0x3FFF: The 9th bit.
+	ramBank   u8   // 0x4000-0x5FFF
+	motor     bool // Bit 3 of 0x4000-0x5FFF on rumble cartridges.
+}
+
+func (m *mbc5) readRom(addr u16) u8 {
+	var bank int
+	if addr >= 0x4000 {
+		// Unlike MBC1 and MBC3, bank 0 can be mapped to 0x4000-0x7FFF.
+		bank = int(m.romBank)
+	}
+	return m.rom[romIndex(m.rom, bank, addr)]
+}
+
+func (m *mbc5) writeRom(addr u16, value u8) {
+	switch {
+	case addr <= 0x1FFF: // RAM Enable
+		m.ramEnable = value&0x0F == 0x0A
+	case addr <= 0x2FFF: // Low 8 bits of ROM Bank Number
+		m.romBank = m.romBank&0x100 | u16(value)
+	case addr <= 0x3FFF: // High bit of ROM Bank Number
+		m.romBank = m.romBank&0x0FF | u16(value&0x01)<<8
+	case addr <= 0x5FFF: // RAM Bank Number
+		if m.rumble == nil {
+			m.ramBank = value & 0x0F
+		} else {
+			// Rumble cartridges use bit 3 for the motor.
+			m.ramBank = value & 0x07
+			m.setMotor(getBit(value, 3))
+		}
+	}
+}
+
+func (m *mbc5) setMotor(motor bool) {
+	if motor == m.motor {
+		return
+	}
+	m.motor = motor
+	m.rumble(motor)
+}
+
+func (m *mbc5) readRam(addr u16) u8 {
+	if !m.ramEnable || len(m.ram) == 0 {
+		return 0xFF
+	}
+	return m.ram[ramIndex(m.ram, int(m.ramBank), addr)]
+}
+
+func (m *mbc5) writeRam(addr u16, value u8) {
+	if m.ramEnable && len(m.ram) != 0 {
+		m.ram[ramIndex(m.ram, int(m.ramBank), addr)] = value
+	}
+}
+
+func (m *mbc5) saveData(timestamp time.Time) []u8 {
+	return copyRam(m.ram)
+}
+
+func (m *mbc5) loadSaveData(data []u8) {
+	loadRam(m.ram, data)
+}
+
+func (m *mbc5) sync(s *serializer) {
+	s.bytes(m.ram)
+	s.bool(&m.ramEnable)
+	s.u16(&m.romBank)
+	s.u8(&m.ramBank)
+	s.bool(&m.motor)
+
+	// Loading a state can change the motor.
+	if !s.saving && m.rumble != nil {
+		m.rumble(m.motor)
+	}
+}
@@ -0,0 +1,240 @@
+/*
+ * gammaboy is a Game Boy emulator.
+ * Copyright (C) 2018  gammpei
+ *
+ * This file is part of gammaboy.
+ *
+ * gammaboy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * gammaboy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with gammaboy.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A rom where every byte of a bank holds the number of the bank.
+func newBankedRom(cartridgeType u8, nbBanks int, ramSize u8) []u8 {
+	rom := make([]u8, nbBanks*0x4000)
+	for i := range rom {
+		rom[i] = u8(i / 0x4000)
+	}
+	rom[0x0147] = cartridgeType
+	rom[0x0149] = ramSize
+	return rom
+}
+
+func expectRead(t *testing.T, name string, actual, expected u8) {
+	if actual != expected {
+		t.Fatalf(`%s: expected 0x%02X, got 0x%02X.`, name, expected, actual)
+	}
+}
+
+func TestMbc1(t *testing.T) {
+	rom := newBankedRom(0x03 /*MBC1+RAM+BATTERY*/, 128, 0x03 /*32KB*/)
+	m := newMbc(rom, nil /*clock*/, nil /*rumble*/)
+
+	expectRead(t, "bank 0", m.readRom(0x3FFF), 0x00)
+	expectRead(t, "default bank", m.readRom(0x4000), 0x01)
+
+	m.writeRom(0x2000, 0x00)
+	expectRead(t, "bank 0 maps to 1", m.readRom(0x4000), 0x01)
+
+	m.writeRom(0x2000, 0x05)
+	m.writeRom(0x4000, 0x02)
+	expectRead(t, "upper bits", m.readRom(0x7FFF), 0x45)
+	expectRead(t, "mode 0 lower area", m.readRom(0x0000), 0x00)
+
+	m.writeRom(0x6000, 0x01)
+	expectRead(t, "mode 1 lower area", m.readRom(0x0000), 0x40)
+
+	expectRead(t, "disabled ram", m.readRam(0xA000), 0xFF)
+	m.writeRom(0x0000, 0x0A)
+	m.writeRam(0xA000, 0x42)
+	expectRead(t, "ram bank 2", m.readRam(0xA000), 0x42)
+	m.writeRom(0x4000, 0x00)
+	expectRead(t, "ram bank 0", m.readRam(0xA000), 0x00)
+	m.writeRom(0x4000, 0x02)
+	expectRead(t, "ram bank 2 again", m.readRam(0xA000), 0x42)
+}
+
+func TestMbc2(t *testing.T) {
+	rom := newBankedRom(0x06 /*MBC2+BATTERY*/, 16, 0x00 /*None*/)
+	m := newMbc(rom, nil /*clock*/, nil /*rumble*/)
+
+	// Bit 8 set: ROM bank number.
+	m.writeRom(0x0100, 0x03)
+	expectRead(t, "rom bank", m.readRom(0x4000), 0x03)
+	m.writeRom(0x2100, 0x00)
+	expectRead(t, "bank 0 maps to 1", m.readRom(0x4000), 0x01)
+
+	// Bit 8 clear: RAM enable.
+	m.writeRom(0x2000, 0x0A)
+	expectRead(t, "rom bank unchanged", m.readRom(0x4000), 0x01)
+	m.writeRam(0xA000, 0x5A)
+	expectRead(t, "upper nibble", m.readRam(0xA000), 0xFA)
+	expectRead(t, "mirror", m.readRam(0xBE00), 0xFA)
+
+	m.writeRom(0x0000, 0x00)
+	expectRead(t, "disabled ram", m.readRam(0xA000), 0xFF)
+}
+
+func TestMbc3Rtc(t *testing.T) {
+	var now time.Duration
+	clock := func() time.Duration { return now }
+
+	rom := newBankedRom(0x10 /*MBC3+TIMER+RAM+BATTERY*/, 128, 0x03 /*32KB*/)
+	m := newMbc(rom, clock, nil /*rumble*/)
+
+	m.writeRom(0x2000, 0x7F)
+	expectRead(t, "rom bank", m.readRom(0x4000), 0x7F)
+
+	m.writeRom(0x0000, 0x0A)
+	latch := func() {
+		m.writeRom(0x6000, 0x00)
+		m.writeRom(0x6000, 0x01)
+	}
+	readRtc := func(reg u8) u8 {
+		m.writeRom(0x4000, reg)
+		return m.readRam(0xA000)
+	}
+
+	now += 511*24*time.Hour + 23*time.Hour + 59*time.Minute + 59*time.Second
+	expectRead(t, "unlatched S", readRtc(0x08), 0x00)
+	latch()
+	expectRead(t, "S", readRtc(0x08), 59)
+	expectRead(t, "M", readRtc(0x09), 59)
+	expectRead(t, "H", readRtc(0x0A), 23)
+	expectRead(t, "DL", readRtc(0x0B), 0xFF)
+	expectRead(t, "DH", readRtc(0x0C), 0x01)
+
+	now += time.Second
+	latch()
+	expectRead(t, "DL after overflow", readRtc(0x0B), 0x00)
+	expectRead(t, "DH after overflow", readRtc(0x0C), 0x80)
+
+	// Halt the clock.
+	m.writeRom(0x4000, 0x0C)
+	m.writeRam(0xA000, 0x40)
+	now += time.Hour
+	latch()
+	expectRead(t, "halted H", readRtc(0x0A), 0)
+	expectRead(t, "halted DH", readRtc(0x0C), 0x40)
+
+	m.writeRom(0x4000, 0x00)
+	m.writeRam(0xA000, 0x42)
+	expectRead(t, "ram", m.readRam(0xA000), 0x42)
+}
+
+func TestMbc5Rumble(t *testing.T) {
+	var rumble []bool
+	rom := newBankedRom(0x1E /*MBC5+RUMBLE+RAM+BATTERY*/, 512, 0x04 /*128KB*/)
+	m := newMbc(rom, nil /*clock*/, func(motor bool) { rumble = append(rumble, motor) })
+
+	m.writeRom(0x2000, 0x00)
+	expectRead(t, "bank 0", m.readRom(0x4000), 0x00)
+	m.writeRom(0x2000, 0xFF)
+	m.writeRom(0x3000, 0x01)
+	expectRead(t, "bank 0x1FF", m.readRom(0x4000), 0xFF)
+	expectRead(t, "bank 0x1FF lower area", m.readRom(0x0000), 0x00)
+
+	m.writeRom(0x4000, 0x08)
+	m.writeRom(0x4000, 0x0F)
+	m.writeRom(0x4000, 0x07)
+	m.writeRom(0x4000, 0x08)
+	expected := []bool{true, false, true}
+	if fmt.Sprint(rumble) != fmt.Sprint(expected) {
+		t.Fatalf(`Expected the rumble events %v, got %v.`, expected, rumble)
+	}
+
+	// Loading a state sends the motor again.
+	s := &serializer{saving: true, writer: &bytes.Buffer{}}
+	m.sync(s)
+	rumble = nil
+	m.sync(&serializer{saving: false, reader: bytes.NewReader(s.writer.Bytes())})
+	if fmt.Sprint(rumble) != fmt.Sprint([]bool{true}) {
+		t.Fatalf(`Expected the motor to be sent after loading, got %v.`, rumble)
+	}
+}
+
+func TestMbc3SaveData(t *testing.T) {
+	var now time.Duration
+	clock := func() time.Duration { return now }
+
+	rom := newBankedRom(0x10 /*MBC3+TIMER+RAM+BATTERY*/, 4, 0x02 /*8KB*/)
+	m := newMbc(rom, clock, nil /*rumble*/)
+	m.writeRom(0x0000, 0x0A)
+	m.writeRam(0xA123, 0x42)
+	now += 3*time.Hour + 2*time.Minute + time.Second
+
+	data := m.saveData(time.Now())
+	if len(data) != 8*1024+rtcSaveDataSize {
+		t.Fatalf(`Unexpected save data size %d.`, len(data))
+	}
+
+	m = newMbc(rom, clock, nil /*rumble*/)
+	m.loadSaveData(data)
+	m.writeRom(0x0000, 0x0A)
+	expectRead(t, "ram", m.readRam(0xA123), 0x42)
+	m.writeRom(0x6000, 0x00)
+	m.writeRom(0x6000, 0x01)
+	m.writeRom(0x4000, 0x0A)
+	expectRead(t, "H", m.readRam(0xA000), 3)
+	m.writeRom(0x4000, 0x09)
+	expectRead(t, "M", m.readRam(0xA000), 2)
+}
+
+func TestSaveFileFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gammaboy")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	rom := newBankedRom(0x10 /*MBC3+TIMER+RAM+BATTERY*/, 4, 0x02 /*8KB*/)
+	m := newMbc(rom, nil /*clock*/, nil /*rumble*/)
+	m.writeRom(0x0000, 0x0A)
+	m.writeRam(0xA000, 0x42)
+	path := filepath.Join(dir, "game.sav")
+	check(ioutil.WriteFile(path, m.saveData(time.Unix(1000000000, 0)), 0644))
+
+	m = newMbc(rom, nil /*clock*/, nil /*rumble*/)
+	saveFile := newSaveFile(path, m)
+	check(os.Remove(path))
+	expectFlush := func(expected bool, context string) {
+		saveFile.flush()
+		_, err := os.Stat(path)
+		if written := err == nil; written != expected {
+			t.Fatalf(`%s: expected the save file to be written: %v.`, context, expected)
+		}
+		os.Remove(path)
+	}
+
+	// Nothing changed, the file isn't written again even though the timestamp did.
+	expectFlush(false, "unchanged")
+	// The timestamp is enough to restore a running clock.
+	m.(*mbc3).rtc.tick(1)
+	expectFlush(false, "clock ticked")
+
+	m.writeRom(0x0000, 0x0A)
+	m.writeRam(0xA000, 0x24)
+	expectFlush(true, "ram written")
+	m.writeRom(0x4000, 0x0C)
+	m.writeRam(0xA000, 0x40) // RTC DH: Halt
+	expectFlush(true, "clock halted")
+}
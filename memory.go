@@ -24,21 +24,38 @@ import (
 	"fmt"
 )
 
+// The memory as seen by the CPU.
 func (st *st) readMem(addr u16) u8 {
+	// During an OAM DMA transfer, the CPU can only access HRAM (and the I/O registers).
+	if st.dma.active && addr < 0xFF00 {
+		return 0xFF
+	}
+	return st.readBus(addr)
+}
+
+// The memory as seen by the DMA.
+func (st *st) readBus(addr u16) u8 {
 	var mask u8 = 0x00
 	switch {
 	case 0x0000 <= addr && addr <= 0x00FF:
 		if st.biosIsEnabled {
 			return bios[addr]
 		} else {
-			return st.rom[addr]
+			return st.mbc.readRom(addr)
 		}
 	case 0x0100 <= addr && addr <= 0x7FFF:
-		return st.rom[addr]
+		return st.mbc.readRom(addr)
 	case 0x8000 <= addr && addr <= 0x97FF: // Tile sets
 	case 0x9800 <= addr && addr <= 0x9FFF: // BG tile maps
+	case 0xA000 <= addr && addr <= 0xBFFF: // External RAM
+		return st.mbc.readRam(addr)
 	case 0xC000 <= addr && addr <= 0xCFFF: // Work RAM Bank 0
 	case 0xD000 <= addr && addr <= 0xDFFF: // Work RAM Bank 1
+	case 0xFE00 <= addr && addr <= 0xFE9F: // OAM: Object Attribute Memory
+	case 0xFEA0 <= addr && addr <= 0xFEFF: // Not usable
+		return 0x00
+	case addr == 0xFF00: // P1: Joypad
+		return st.readJoypad()
 	case addr == 0xFF01: // SB: Serial transfer data
 	case addr == 0xFF04: // DIV: Divider register
 		return u8(st.timing.systemClock >> 8)
@@ -48,12 +65,27 @@ func (st *st) readMem(addr u16) u8 {
 		mask = 0xF8
 	case addr == 0xFF0F: // IF: Interrupt Flag
 		mask = 0xE0
+	case 0xFF10 <= addr && addr <= 0xFF3F: // Sound registers and Wave Pattern RAM
+		return st.readApu(addr)
 	case addr == 0xFF40: // LCDC: LCD Control
+	case addr == 0xFF41: // STAT: LCDC Status
+		return st.readStat()
 	case addr == 0xFF42: // SCY: Scroll Y
 	case addr == 0xFF43: // SCX: Scroll X
 	case addr == 0xFF44: // LY: LCDC Y-Coordinate
-		return getScanline(st)
+		return st.ppu.ly
+	case addr == 0xFF45: // LYC: LY Compare
+	case addr == 0xFF46: // DMA: DMA Transfer and Start Address
 	case addr == 0xFF47: // BGP: BackGround Palette
+	case addr == 0xFF48: // OBP0: Object Palette 0
+	case addr == 0xFF49: // OBP1: Object Palette 1
+	case addr == 0xFF4A: // WY: Window Y
+	case addr == 0xFF4B: // WX: Window X
+	case addr == 0xFF4D: // KEY1: Prepare speed switch (CGB only)
+		if !st.cgb {
+			return 0xFF
+		}
+		return st.mem[addr]&0x01 | 0x7E | u8FromBool(st.doubleSpeed)<<7
 	case 0xFF80 <= addr && addr <= 0xFFFE: // Zero Page
 	case addr == 0xFFFF: // IE: Interrupt Enable
 	default:
@@ -65,11 +97,28 @@ func (st *st) readMem(addr u16) u8 {
 }
 
 func (st *st) writeMem(addr u16, value u8) {
+	// During an OAM DMA transfer, the CPU can only access HRAM (and the I/O registers).
+	if st.dma.active && addr < 0xFF00 {
+		return
+	}
+
 	switch {
+	case 0x0000 <= addr && addr <= 0x7FFF: // MBC registers
+		st.mbc.writeRom(addr, value)
+		return
 	case 0x8000 <= addr && addr <= 0x97FF: // Tile sets
 	case 0x9800 <= addr && addr <= 0x9FFF: // BG tile maps
+	case 0xA000 <= addr && addr <= 0xBFFF: // External RAM
+		st.mbc.writeRam(addr, value)
+		return
 	case 0xC000 <= addr && addr <= 0xCFFF: // Work RAM Bank 0
 	case 0xD000 <= addr && addr <= 0xDFFF: // Work RAM Bank 1
+	case 0xFE00 <= addr && addr <= 0xFE9F: // OAM: Object Attribute Memory
+	case 0xFEA0 <= addr && addr <= 0xFEFF: // Not usable
+		return
+	case addr == 0xFF00: // P1: Joypad
+		st.writeJoypad(value)
+		return
 	case addr == 0xFF01: // SB: Serial transfer data
 	case addr == 0xFF02 && value == 0x81: // SC: Serial transfer Control
 		b := st.readMem(0xFF01)
@@ -85,23 +134,38 @@ func (st *st) writeMem(addr u16, value u8) {
 	case addr == 0xFF06: // TMA: Timer modulo
 	case addr == 0xFF07: // TAC: Timer control
 	case addr == 0xFF0F: // IF: Interrupt Flag
-	case 0xFF11 <= addr && addr <= 0xFF14: // TODO Audio
-	case 0xFF24 <= addr && addr <= 0xFF26: // TODO Audio
+	case 0xFF10 <= addr && addr <= 0xFF3F: // Sound registers and Wave Pattern RAM
+		st.writeApu(addr, value)
+		return
 	case addr == 0xFF40: // LCDC: LCD Control
+	case addr == 0xFF41: // STAT: LCDC Status
+		// Only the interrupt enable bits are writable.
+		value = value & 0x78
 	case addr == 0xFF42: // SCY: Scroll Y
 	case addr == 0xFF43: // SCX: Scroll X
+	case addr == 0xFF45: // LYC: LY Compare
+	case addr == 0xFF46: // DMA: DMA Transfer and Start Address
+		st.startDma(value)
 	case addr == 0xFF47: // BGP: BackGround Palette
+	case addr == 0xFF48: // OBP0: Object Palette 0
+	case addr == 0xFF49: // OBP1: Object Palette 1
 	case addr == 0xFF4A: // WY: Window Y
 	case addr == 0xFF4B: // WX: Window X
+	case addr == 0xFF4D: // KEY1: Prepare speed switch (CGB only)
+		if !st.cgb {
+			return
+		}
+		// Only the switch armed bit is writable.
+		value = value & 0x01
 	case addr == 0xFF50:
 		st.biosIsEnabled = false
 	case 0xFF80 <= addr && addr <= 0xFFFE: // Zero Page
 	case addr == 0xFFFF: // IE: Interrupt Enable
-		assert(!getBit(value, 0)) // V-Blank
-		assert(!getBit(value, 1)) // LCD STAT
+		// V-Blank
+		// LCD STAT
 		// Timer
 		assert(!getBit(value, 3)) // Serial
-		assert(!getBit(value, 4)) // Joypad
+		// Joypad
 	default:
 		panic(fmt.Sprintf("Unimplemented memory write 0x%02X=0b%08b at (0x%04X) and PC=0x%04X.",
 			value, value, addr, PC.get(st),
@@ -110,17 +174,21 @@ func (st *st) writeMem(addr u16, value u8) {
 	st.mem[addr] = value
 }
 
-func (st *st) readMem_u16(addr u16) u16 {
-	littleEnd := st.readMem(addr)
-	bigEnd := st.readMem(addr + 1)
-	return (u16(bigEnd) << 8) | u16(littleEnd)
+// Each memory access of the CPU takes one M-cycle (4 cycles).
+// The clock is advanced before the access, so that the PPU and the timer are where they would be at that point.
+func (st *st) cycle() {
+	st.addCycles(4)
+	st.timing.instrCycles += 4
+}
+
+func (st *st) readCycle(addr u16) u8 {
+	st.cycle()
+	return st.readMem(addr)
 }
 
-func (st *st) writeMem_u16(addr u16, value u16) {
-	littleEnd := u8(value)
-	bigEnd := u8(value >> 8)
-	st.writeMem(addr, littleEnd)
-	st.writeMem(addr+1, bigEnd)
+func (st *st) writeCycle(addr u16, value u8) {
+	st.cycle()
+	st.writeMem(addr, value)
 }
 
 func (st *st) requestInterrupt(i uint) u8 {
@@ -148,12 +216,12 @@ func (mem mem) toString(st *st) string {
 
 func (mem mem) get(st *st) u8 {
 	addr := mem.addr.get(st)
-	return st.readMem(addr)
+	return st.readCycle(addr)
 }
 
 func (mem mem) set(st *st, value u8) {
 	addr := mem.addr.get(st)
-	st.writeMem(addr, value)
+	st.writeCycle(addr, value)
 }
 
 type mem_u16 mem
@@ -168,7 +236,8 @@ func (m mem_u16) toString(st *st) string {
 
 func (m mem_u16) set(st *st, value u16) {
 	addr := m.addr.get(st)
-	st.writeMem_u16(addr, value)
+	st.writeCycle(addr, u8(value))
+	st.writeCycle(addr+1, u8(value>>8))
 }
 
 // ----------------
@@ -188,9 +257,8 @@ func (imm_u8_t) toString(st *st) string {
 }
 
 func (imm_u8_t) get(st *st) u8 {
-	// When this is called, PC has already been incremented
-	// so we need to read the previous byte.
-	return st.readMem(PC.get(st) - imm_u8.sizeOf())
+	// Fetched by fetchDecodeExecute.
+	return st.immediate[0]
 }
 
 type imm_i8_t struct{}
@@ -225,7 +293,6 @@ func (imm_u16_t) toString(st *st) string {
 }
 
 func (imm_u16_t) get(st *st) u16 {
-	// When this is called, PC has already been incremented
-	// so we need to read the previous two bytes.
-	return st.readMem_u16(PC.get(st) - imm_u16.sizeOf())
+	// Fetched by fetchDecodeExecute.
+	return u16(st.immediate[1])<<8 | u16(st.immediate[0])
 }
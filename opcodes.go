@@ -91,9 +91,58 @@ var N = map[string]const_u3{
 	"111": 7,
 }
 
+// The number of cycles of each instruction (pandocs.htm).
+// For the conditional instructions, when the condition is false.
+var cycles = [256]int{
+	4, 12, 8, 8, 4, 4, 8, 4, 20, 8, 8, 8, 4, 4, 8, 4, // 0x
+	4, 12, 8, 8, 4, 4, 8, 4, 12, 8, 8, 8, 4, 4, 8, 4, // 1x
+	8, 12, 8, 8, 4, 4, 8, 4, 8, 8, 8, 8, 4, 4, 8, 4, // 2x
+	8, 12, 8, 8, 12, 12, 12, 4, 8, 8, 8, 8, 4, 4, 8, 4, // 3x
+	4, 4, 4, 4, 4, 4, 8, 4, 4, 4, 4, 4, 4, 4, 8, 4, // 4x
+	4, 4, 4, 4, 4, 4, 8, 4, 4, 4, 4, 4, 4, 4, 8, 4, // 5x
+	4, 4, 4, 4, 4, 4, 8, 4, 4, 4, 4, 4, 4, 4, 8, 4, // 6x
+	8, 8, 8, 8, 8, 8, 4, 8, 4, 4, 4, 4, 4, 4, 8, 4, // 7x
+	4, 4, 4, 4, 4, 4, 8, 4, 4, 4, 4, 4, 4, 4, 8, 4, // 8x
+	4, 4, 4, 4, 4, 4, 8, 4, 4, 4, 4, 4, 4, 4, 8, 4, // 9x
+	4, 4, 4, 4, 4, 4, 8, 4, 4, 4, 4, 4, 4, 4, 8, 4, // Ax
+	4, 4, 4, 4, 4, 4, 8, 4, 4, 4, 4, 4, 4, 4, 8, 4, // Bx
+	8, 12, 12, 16, 12, 16, 8, 16, 8, 16, 12, 0, 12, 24, 8, 16, // Cx
+	8, 12, 12, 0, 12, 16, 8, 16, 8, 16, 12, 0, 12, 0, 8, 16, // Dx
+	12, 12, 8, 0, 0, 16, 8, 16, 16, 4, 16, 0, 0, 0, 8, 16, // Ex
+	12, 12, 8, 4, 0, 16, 8, 16, 12, 8, 16, 4, 0, 0, 8, 16, // Fx
+}
+
+// The 0xCB prefix included.
+var extendedCycles = [256]int{
+	8, 8, 8, 8, 8, 8, 16, 8, 8, 8, 8, 8, 8, 8, 16, 8, // 0x
+	8, 8, 8, 8, 8, 8, 16, 8, 8, 8, 8, 8, 8, 8, 16, 8, // 1x
+	8, 8, 8, 8, 8, 8, 16, 8, 8, 8, 8, 8, 8, 8, 16, 8, // 2x
+	8, 8, 8, 8, 8, 8, 16, 8, 8, 8, 8, 8, 8, 8, 16, 8, // 3x
+	8, 8, 8, 8, 8, 8, 12, 8, 8, 8, 8, 8, 8, 8, 12, 8, // 4x
+	8, 8, 8, 8, 8, 8, 12, 8, 8, 8, 8, 8, 8, 8, 12, 8, // 5x
+	8, 8, 8, 8, 8, 8, 12, 8, 8, 8, 8, 8, 8, 8, 12, 8, // 6x
+	8, 8, 8, 8, 8, 8, 12, 8, 8, 8, 8, 8, 8, 8, 12, 8, // 7x
+	8, 8, 8, 8, 8, 8, 16, 8, 8, 8, 8, 8, 8, 8, 16, 8, // 8x
+	8, 8, 8, 8, 8, 8, 16, 8, 8, 8, 8, 8, 8, 8, 16, 8, // 9x
+	8, 8, 8, 8, 8, 8, 16, 8, 8, 8, 8, 8, 8, 8, 16, 8, // Ax
+	8, 8, 8, 8, 8, 8, 16, 8, 8, 8, 8, 8, 8, 8, 16, 8, // Bx
+	8, 8, 8, 8, 8, 8, 16, 8, 8, 8, 8, 8, 8, 8, 16, 8, // Cx
+	8, 8, 8, 8, 8, 8, 16, 8, 8, 8, 8, 8, 8, 8, 16, 8, // Dx
+	8, 8, 8, 8, 8, 8, 16, 8, 8, 8, 8, 8, 8, 8, 16, 8, // Ex
+	8, 8, 8, 8, 8, 8, 16, 8, 8, 8, 8, 8, 8, 8, 16, 8, // Fx
+}
+
+// The additional cycles of the conditional instructions when the condition is true.
+var takenCycles = map[*operation]int{
+	JR2:   4,
+	JP2:   4,
+	CALL2: 12,
+	RET1:  12,
+}
+
 func buildJumpTable() {
 	add := func(strOpcode string, operation *operation, operands ...operand) {
-		addOpcode(&jumpTable, strOpcode, operation, operands)
+		addOpcode(&jumpTable, &cycles, strOpcode, operation, operands)
 	}
 
 	// NOP
@@ -156,6 +205,7 @@ func buildJumpTable() {
 	add("00011111", RRA)
 
 	// STOP
+	add("00010000", STOP)
 
 	// JR N
 	add("00011000", JR1, imm_i8)
@@ -199,6 +249,7 @@ func buildJumpTable() {
 	}
 
 	// HALT
+	add("01110110", HALT)
 
 	// ALU A,D
 	for iii, operation := range ALU {
@@ -305,7 +356,7 @@ func buildJumpTable() {
 
 func buildExtendedJumpTable() {
 	add := func(strOpcode string, operation *operation, operands ...operand) {
-		addOpcode(&extendedJumpTable, strOpcode, operation, operands)
+		addOpcode(&extendedJumpTable, &extendedCycles, strOpcode, operation, operands)
 	}
 
 	// RdC D
@@ -364,7 +415,7 @@ func buildExtendedJumpTable() {
 	}
 }
 
-func addOpcode(jumpTable *[256]*instr, strOpcode string, operation *operation, operands []operand) {
+func addOpcode(jumpTable *[256]*instr, cycles *[256]int, strOpcode string, operation *operation, operands []operand) {
 	assert(len(strOpcode) == 8)
 	opcode64, err := strconv.ParseUint(strOpcode, 2 /*base*/, 8 /*bitsize*/)
 	check(err)
@@ -372,5 +423,6 @@ func addOpcode(jumpTable *[256]*instr, strOpcode string, operation *operation, o
 	opcode := u8(opcode64)
 
 	assert(jumpTable[opcode] == nil)
-	jumpTable[opcode] = newInstr(operation, operands)
+	assert(cycles[opcode] > 0)
+	jumpTable[opcode] = newInstr(operation, operands, cycles[opcode])
 }
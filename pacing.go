@@ -0,0 +1,96 @@
+/*
+ * gammaboy is a Game Boy emulator.
+ * Copyright (C) 2018  gammpei
+ *
+ * This file is part of gammaboy.
+ *
+ * gammaboy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * gammaboy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with gammaboy.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"time"
+)
+
+// 4.194304 MHz, 154 * 456 cycles per frame
+const frameRate = float64(clockFrequency) / cyclesPerFrame // ~59.73 Hz
+const framePeriod = cyclesPerFrame * time.Second / clockFrequency
+
+// If we fall behind by more than this, we give up on catching up.
+const maxFrameDrift = 5 * framePeriod
+
+// Keeps the emulation at the speed of the real Game Boy, or a multiple of it.
+type frameLimiter struct {
+	// When the next frame should be presented.
+	// It advances by exactly one frame period every frame so that the errors don't accumulate.
+	deadline time.Time
+	// If the display refreshes at about the rate of the Game Boy, we run at the rate of the display
+	// so that presenting with vsync paces the frames without stutter, and the small difference
+	// is absorbed by the audio rate control. 0 otherwise.
+	vsyncPeriod time.Duration
+	lastPresent time.Time
+}
+
+// Without the audio rate control, we stick to the rate of the Game Boy.
+func newFrameLimiter(displayRefreshRate int, hasAudio bool) *frameLimiter {
+	difference := (float64(displayRefreshRate) - frameRate) / frameRate
+	var vsyncPeriod time.Duration = 0
+	if hasAudio && -maxRateAdjustment < difference && difference < maxRateAdjustment {
+		vsyncPeriod = time.Second / time.Duration(displayRefreshRate)
+	}
+	return &frameLimiter{
+		deadline:    time.Now(),
+		vsyncPeriod: vsyncPeriod,
+		lastPresent: time.Now(),
+	}
+}
+
+// Sleeps until it is time to present the next frame.
+// speed is a multiple of the Game Boy speed, 0 means uncapped.
+func (limiter *frameLimiter) wait(speed float64) {
+	if speed == 0 {
+		limiter.deadline = time.Now()
+		return
+	}
+
+	period := time.Duration(float64(framePeriod) / speed)
+	var slack time.Duration = 0
+	if speed == 1 && limiter.vsyncPeriod != 0 {
+		// Presenting normally waits for vsync, we only sleep if it returned early
+		// (vsync disabled by the driver, minimized window...).
+		period = limiter.vsyncPeriod
+		slack = period / 2
+	}
+
+	limiter.deadline = limiter.deadline.Add(period)
+	now := time.Now()
+	if drift := now.Sub(limiter.deadline); drift > maxFrameDrift {
+		// The host is too slow, or we were paused.
+		limiter.deadline = now
+		return
+	}
+	time.Sleep(limiter.deadline.Add(-slack).Sub(now))
+}
+
+// When running faster than the Game Boy, we skip frames since presenting with vsync would
+// limit us to the refresh rate of the display.
+func (limiter *frameLimiter) shouldPresent(speed float64) bool {
+	now := time.Now()
+	if 0 < speed && speed <= 1 || now.Sub(limiter.lastPresent) >= framePeriod {
+		limiter.lastPresent = now
+		return true
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+/*
+ * gammaboy is a Game Boy emulator.
+ * Copyright (C) 2018  gammpei
+ *
+ * This file is part of gammaboy.
+ *
+ * gammaboy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * gammaboy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with gammaboy.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFrameLimiterWait(t *testing.T) {
+	for _, c := range []struct {
+		refreshRate int
+		hasAudio    bool
+		speed       float64
+		min, max    time.Duration
+		context     string
+	}{
+		{0, false, 1, 3 * framePeriod, 5 * framePeriod, "no vsync"},
+		{0, false, 2, 3 * framePeriod / 2, 5 * framePeriod / 2, "2x"},
+		{0, false, 0, 0, framePeriod, "uncapped"},
+		// The presents return right away, as if vsync wasn't honored.
+		{60, true, 1, 2 * time.Second / 60, 5 * time.Second / 60, "vsync not honored"},
+		// Without audio, there is no rate control to absorb the difference with the display.
+		{60, false, 1, 3 * framePeriod, 5 * framePeriod, "60 Hz without audio"},
+	} {
+		limiter := newFrameLimiter(c.refreshRate, c.hasAudio)
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			limiter.wait(c.speed)
+		}
+		if elapsed := time.Since(start); elapsed < c.min || elapsed > c.max {
+			t.Fatalf(`%s: expected 3 frames to take %v to %v, took %v.`, c.context, c.min, c.max, elapsed)
+		}
+	}
+
+	limiter := newFrameLimiter(0, false)
+	limiter.deadline = time.Now().Add(-time.Second)
+	start := time.Now()
+	limiter.wait(1)
+	if elapsed := time.Since(start); elapsed > framePeriod {
+		t.Fatalf(`Expected the limiter to give up on catching up, waited %v.`, elapsed)
+	}
+}
+
+func TestFrameLimiterShouldPresent(t *testing.T) {
+	limiter := newFrameLimiter(0, false)
+	if !limiter.shouldPresent(1) || !limiter.shouldPresent(1) {
+		t.Fatalf(`Expected every frame to be presented at 1x.`)
+	}
+	if limiter.shouldPresent(4) {
+		t.Fatalf(`Expected a frame to be skipped right after a present at 4x.`)
+	}
+	limiter.lastPresent = time.Now().Add(-framePeriod)
+	if !limiter.shouldPresent(4) {
+		t.Fatalf(`Expected a frame to be presented after a frame period at 4x.`)
+	}
+	if limiter.shouldPresent(0) {
+		t.Fatalf(`Expected a frame to be skipped right after a present when uncapped.`)
+	}
+}
@@ -0,0 +1,378 @@
+/*
+ * gammaboy is a Game Boy emulator.
+ * Copyright (C) 2018  gammpei
+ *
+ * This file is part of gammaboy.
+ *
+ * gammaboy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * gammaboy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with gammaboy.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"sort"
+)
+
+// The LCD takes 456 cycles to draw one line.
+// It has 154 lines (144 visible lines + 10 "V-blank lines").
+const dotsPerLine = 456
+const linesPerFrame = 154
+const cyclesPerFrame = dotsPerLine * linesPerFrame
+
+// The LCD modes, as in the lower 2 bits of STAT.
+const (
+	modeHBlank        = 0
+	modeVBlank        = 1
+	modeOamSearch     = 2
+	modePixelTransfer = 3
+)
+
+// The Pixel Processing Unit.
+type ppu struct {
+	lcdOn bool
+	dot   int // The position in the current line (0-455).
+	ly    u8  // LY: LCDC Y-Coordinate
+	mode  u8
+
+	// The 4 sources of the LCD STAT interrupt are ORed together,
+	// the interrupt is requested on the rising edge.
+	statLine bool
+
+	// While the LCD is off, we still count the cycles to produce blank frames.
+	offCycles int
+
+	// The window is only drawn once LY has been equal to WY during the frame.
+	windowTriggered bool
+	// The line of the window to draw next, it only advances on the lines where the window is drawn.
+	windowLine u8
+
+	// The shades (0-3) of the pixels, each line is drawn at the start of its mode 3.
+	frame      [144][160]u8
+	frameReady bool // Set at the start of V-Blank, when the frame is complete.
+}
+
+// Advances the PPU by one cycle.
+func (st *st) stepPpu() {
+	ppu := &st.ppu
+
+	LCDC := st.mem[0xFF40] // LCD Control
+	if !getBit(LCDC, 7) {
+		if ppu.lcdOn {
+			ppu.lcdOn = false
+			ppu.dot = 0
+			ppu.ly = 0
+			ppu.mode = modeHBlank
+			ppu.offCycles = 0
+			ppu.statLine = false
+			ppu.windowTriggered = false
+			ppu.windowLine = 0
+			ppu.frame = [144][160]u8{} // White
+		}
+
+		ppu.offCycles++
+		if ppu.offCycles == cyclesPerFrame {
+			ppu.offCycles = 0
+			ppu.frameReady = true
+		}
+		return
+	}
+	if !ppu.lcdOn {
+		// The LCD starts again from the top-left corner.
+		ppu.lcdOn = true
+		ppu.dot = 0
+		ppu.ly = 0
+		ppu.mode = modeOamSearch
+		return
+	}
+
+	ppu.dot++
+	if ppu.dot == dotsPerLine {
+		ppu.dot = 0
+		ppu.ly = (ppu.ly + 1) % linesPerFrame
+	}
+
+	switch {
+	case ppu.ly >= 144:
+		if ppu.ly == 144 && ppu.dot == 0 {
+			ppu.frameReady = true
+			ppu.windowTriggered = false
+			ppu.windowLine = 0
+			st.requestInterrupt(0) // Request V-Blank interrupt.
+		}
+		ppu.mode = modeVBlank
+	case ppu.dot < 80:
+		ppu.mode = modeOamSearch
+	case ppu.dot < 80+172:
+		if ppu.dot == 80 {
+			// Draw the whole line at once (good enough for now).
+			st.drawLine()
+		}
+		ppu.mode = modePixelTransfer
+	default:
+		ppu.mode = modeHBlank
+	}
+
+	st.updateStatLine()
+}
+
+// STAT: LCDC Status
+func (st *st) readStat() u8 {
+	STAT := st.mem[0xFF41]&0x78 | 0x80                  // Bit 7 is unused.
+	STAT = setBit(STAT, 2, st.ppu.ly == st.mem[0xFF45]) // Coincidence flag (LYC=LY)
+	return STAT | st.ppu.mode
+}
+
+func (st *st) updateStatLine() {
+	ppu := &st.ppu
+	STAT := st.readStat()
+
+	statLine := false
+	switch {
+	case ppu.mode == modeHBlank && getBit(STAT, 3):
+		statLine = true
+	case ppu.mode == modeVBlank && getBit(STAT, 4):
+		statLine = true
+	case ppu.mode == modeOamSearch && getBit(STAT, 5):
+		statLine = true
+	case getBit(STAT, 2) && getBit(STAT, 6): // LYC=LY
+		statLine = true
+	}
+
+	if statLine && !ppu.statLine {
+		st.requestInterrupt(1) // Request LCD STAT interrupt.
+	}
+	ppu.statLine = statLine
+}
+
+func (st *st) drawLine() {
+	ppu := &st.ppu
+	y := ppu.ly
+	assert(y < 144)
+
+	LCDC := st.mem[0xFF40] // LCD Control
+	BGP := st.mem[0xFF47]  // BackGround Palette
+
+	// The color numbers (0-3) of the background, before the palette.
+	var bg [160]u8
+	bgDisplayEnable := getBit(LCDC, 0)
+	if bgDisplayEnable {
+		var bgTileMap u16
+		switch getBit(LCDC, 3) {
+		case false:
+			bgTileMap = 0x9800 // 0x9800-0x9BFF
+		case true:
+			bgTileMap = 0x9C00 // 0x9C00-0x9FFF
+		}
+
+		SCX := st.mem[0xFF43] // Scroll X
+		SCY := st.mem[0xFF42] // Scroll Y
+		for x := 0; x < 160; x++ {
+			bgX := SCX + u8(x)
+			bgY := SCY + y
+			bg[x] = st.tileMapPixel(bgTileMap, bgX, bgY)
+		}
+	}
+
+	WY := st.mem[0xFF4A] // Window Y
+	WX := st.mem[0xFF4B] // Window X + 7
+	if y == WY {
+		ppu.windowTriggered = true
+	}
+	// On the DMG, disabling the background also disables the window.
+	windowDisplayEnable := getBit(LCDC, 5)
+	if bgDisplayEnable && windowDisplayEnable && ppu.windowTriggered && WX <= 166 {
+		var windowTileMap u16
+		switch getBit(LCDC, 6) {
+		case false:
+			windowTileMap = 0x9800 // 0x9800-0x9BFF
+		case true:
+			windowTileMap = 0x9C00 // 0x9C00-0x9FFF
+		}
+
+		windowX := int(WX) - 7
+		for x := 0; x < 160; x++ {
+			if x >= windowX {
+				bg[x] = st.tileMapPixel(windowTileMap, u8(x-windowX), ppu.windowLine)
+			}
+		}
+		ppu.windowLine++
+	}
+
+	for x := 0; x < 160; x++ {
+		if bgDisplayEnable {
+			ppu.frame[y][x] = applyPalette(BGP, bg[x])
+		} else {
+			ppu.frame[y][x] = 0 // White, whatever the palette.
+		}
+	}
+
+	objDisplayEnable := getBit(LCDC, 1)
+	if objDisplayEnable {
+		st.drawSprites(&bg)
+	}
+}
+
+// An entry of the OAM (Object Attribute Memory).
+type sprite struct {
+	y     u8 // The y position + 16.
+	x     u8 // The x position + 8.
+	tile  u8
+	flags u8
+}
+
+func (st *st) spriteHeight() int {
+	LCDC := st.mem[0xFF40] // LCD Control
+	if getBit(LCDC, 2) {
+		return 16
+	}
+	return 8
+}
+
+// The sprites on the current line, sorted by priority.
+func (st *st) lineSprites() []sprite {
+	ly := int(st.ppu.ly)
+	height := st.spriteHeight()
+
+	// Only the first 10 sprites of the OAM on a line are drawn.
+	sprites := make([]sprite, 0, 10)
+	for i := 0; i < 40 && len(sprites) < 10; i++ {
+		addr := 0xFE00 + u16(i*4)
+		sprite := sprite{
+			y:     st.mem[addr],
+			x:     st.mem[addr+1],
+			tile:  st.mem[addr+2],
+			flags: st.mem[addr+3],
+		}
+		top := int(sprite.y) - 16
+		if top <= ly && ly < top+height {
+			sprites = append(sprites, sprite)
+		}
+	}
+
+	// On the DMG, the sprite with the smallest x has priority,
+	// then the sprite that comes first in the OAM.
+	sort.SliceStable(sprites, func(i, j int) bool {
+		return sprites[i].x < sprites[j].x
+	})
+	return sprites
+}
+
+// bg holds the color numbers of the background, before the palette.
+func (st *st) drawSprites(bg *[160]u8) {
+	ppu := &st.ppu
+	ly := int(ppu.ly)
+	height := st.spriteHeight()
+	sprites := st.lineSprites()
+
+	for x := 0; x < 160; x++ {
+		for _, sprite := range sprites {
+			spriteX := x - (int(sprite.x) - 8)
+			if spriteX < 0 || spriteX >= 8 {
+				continue
+			}
+			spriteY := ly - (int(sprite.y) - 16)
+
+			xFlip := getBit(sprite.flags, 5)
+			if xFlip {
+				spriteX = 7 - spriteX
+			}
+			yFlip := getBit(sprite.flags, 6)
+			if yFlip {
+				spriteY = height - 1 - spriteY
+			}
+
+			tile := sprite.tile
+			if height == 16 {
+				// The lowest bit of the tile number is ignored in 8x16 mode.
+				tile &= 0xFE
+			}
+			tileAddr := 0x8000 + u16(tile)*16 + u16(spriteY/8)*16
+			color := st.tilePixel(tileAddr, u8(spriteX), u8(spriteY%8))
+			if color == 0 {
+				// Transparent, the next sprite might be visible.
+				continue
+			}
+
+			// The background colors 1-3 are drawn over the sprite.
+			bgOverObj := getBit(sprite.flags, 7)
+			if !(bgOverObj && bg[x] != 0) {
+				var palette u8
+				switch getBit(sprite.flags, 4) {
+				case false:
+					palette = st.mem[0xFF48] // OBP0: Object Palette 0
+				case true:
+					palette = st.mem[0xFF49] // OBP1: Object Palette 1
+				}
+				ppu.frame[ly][x] = applyPalette(palette, color)
+			}
+
+			// Sprites with a lower priority are hidden, even behind the background.
+			break
+		}
+	}
+}
+
+// The color number (0-3) of the pixel (x, y) of the 256x256 image described by a tile map.
+func (st *st) tileMapPixel(tileMap u16, x, y u8) u8 {
+	LCDC := st.mem[0xFF40] // LCD Control
+
+	tileMapIndex := u16(y/8)*32 + u16(x/8)
+	tileSetIndex := st.mem[tileMap+tileMapIndex]
+
+	var tileAddr u16
+	switch getBit(LCDC, 4) {
+	case false:
+		// 0x8800-0x97FF, the index is signed and 0 is at 0x9000.
+		tileAddr = u16(0x9000 + int(i8(tileSetIndex))*16)
+	case true:
+		// 0x8000-0x8FFF
+		tileAddr = 0x8000 + u16(tileSetIndex)*16
+	}
+
+	return st.tilePixel(tileAddr, x%8, y%8)
+}
+
+// The color number (0-3) of the pixel (x, y) of a 8x8 tile.
+func (st *st) tilePixel(tileAddr u16, x, y u8) u8 {
+	assert(x < 8 && y < 8)
+	lineAddr := tileAddr + u16(y)*2
+	lowBits := st.mem[lineAddr]
+	highBits := st.mem[lineAddr+1]
+
+	bit := uint(7 - x)
+	l := u8FromBool(getBit(lowBits, bit))
+	h := u8FromBool(getBit(highBits, bit))
+	return h<<1 | l
+}
+
+// The shade (0-3) of a color number (0-3) through a palette register.
+func applyPalette(palette u8, color u8) u8 {
+	assert(color <= 3)
+	return (palette >> (color * 2)) & 0x03
+}
+
+func (ppu *ppu) sync(s *serializer) {
+	s.bool(&ppu.lcdOn)
+	s.int(&ppu.dot)
+	s.u8(&ppu.ly)
+	s.u8(&ppu.mode)
+	s.bool(&ppu.statLine)
+	s.int(&ppu.offCycles)
+	s.bool(&ppu.windowTriggered)
+	s.u8(&ppu.windowLine)
+	for y := range ppu.frame {
+		s.bytes(ppu.frame[y][:])
+	}
+	s.bool(&ppu.frameReady)
+}
@@ -0,0 +1,231 @@
+/*
+ * gammaboy is a Game Boy emulator.
+ * Copyright (C) 2018  gammpei
+ *
+ * This file is part of gammaboy.
+ *
+ * gammaboy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * gammaboy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with gammaboy.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func newTestPpuState() *st {
+	st := newState(newBankedRom(0x00 /*ROM ONLY*/, 2, 0x00 /*None*/), nil /*linkCable*/, false /*useWallClock*/)
+	st.mem[0xFF40] = 0x93 // LCD on, tile set 0x8000, OBJ on, BG on
+	st.mem[0xFF47] = 0xE4 // BGP: Identity
+	st.mem[0xFF48] = 0xE4 // OBP0: Identity
+	st.mem[0xFF49] = 0x1B // OBP1: Inverted
+
+	// Tile 1 is color 3, tile 2 is color 1.
+	for i := u16(0); i < 16; i += 2 {
+		st.mem[0x8010+i] = 0xFF
+		st.mem[0x8010+i+1] = 0xFF
+		st.mem[0x8020+i] = 0xFF
+	}
+	return st
+}
+
+func setSprite(st *st, i int, x, y int, tile, flags u8) {
+	addr := 0xFE00 + u16(i*4)
+	st.mem[addr] = u8(y + 16)
+	st.mem[addr+1] = u8(x + 8)
+	st.mem[addr+2] = tile
+	st.mem[addr+3] = flags
+}
+
+func expectLine(t *testing.T, st *st, y int, expected map[int]u8) {
+	for x, shade := range expected {
+		if actual := st.ppu.frame[y][x]; actual != shade {
+			t.Fatalf(`Expected shade %d at (%d, %d), got %d.`, shade, x, y, actual)
+		}
+	}
+}
+
+func TestSprites(t *testing.T) {
+	st := newTestPpuState()
+	st.mem[0x9800] = 0x02 // The first BG tile is color 1.
+
+	setSprite(st, 0, 10, 0, 0x02, 0x00)
+	setSprite(st, 1, 5, 0, 0x01, 0x80)  // Behind BG colors 1-3.
+	setSprite(st, 2, 30, 0, 0x01, 0x10) // OBP1
+	for i := 3; i < 11; i++ {
+		setSprite(st, i, 40+i*8, 0, 0x01, 0x00)
+	}
+
+	st.ppu.ly = 0
+	st.drawLine()
+	expectLine(t, st, 0, map[int]u8{
+		4:   1, // BG
+		5:   1, // BG over OBJ
+		8:   3, // OBJ 1
+		12:  3, // OBJ 1 has priority over OBJ 0 since its x is smaller.
+		13:  1, // OBJ 0
+		18:  0,
+		30:  0, // OBP1
+		112: 3, // The 10th sprite
+		120: 0, // The 11th sprite isn't drawn.
+	})
+}
+
+func TestTallSprites(t *testing.T) {
+	st := newTestPpuState()
+	st.mem[0xFF40] |= 0x04 // 8x16 sprites
+
+	// Tiles 2 and 3 form the sprite, the lowest bit of the tile number is ignored.
+	setSprite(st, 0, 0, 0, 0x03, 0x00)
+	setSprite(st, 1, 20, 0, 0x02, 0x40) // Y flip
+
+	st.ppu.ly = 0
+	st.drawLine()
+	expectLine(t, st, 0, map[int]u8{0: 1, 20: 0})
+
+	st.ppu.ly = 15
+	st.drawLine()
+	expectLine(t, st, 15, map[int]u8{0: 0, 20: 1})
+}
+
+func TestWindow(t *testing.T) {
+	st := newTestPpuState()
+	st.mem[0xFF40] |= 0x60 // Window on, window tile map 0x9C00
+	st.mem[0xFF4A] = 2     // WY
+	st.mem[0xFF4B] = 7 + 4 // WX
+	st.mem[0x9C00] = 0x01  // The first window tile is color 3.
+
+	for y := u8(0); y < 12; y++ {
+		if y == 5 {
+			// Hide the window on this line, its line counter doesn't advance.
+			st.mem[0xFF40] &^= 0x20
+		}
+		st.ppu.ly = y
+		st.drawLine()
+		st.mem[0xFF40] |= 0x20
+	}
+
+	expectLine(t, st, 1, map[int]u8{4: 0})
+	expectLine(t, st, 2, map[int]u8{3: 0, 4: 3, 11: 3, 12: 0})
+	expectLine(t, st, 5, map[int]u8{4: 0})
+	expectLine(t, st, 10, map[int]u8{4: 3})
+	expectLine(t, st, 11, map[int]u8{4: 0}) // The 9th line of the window.
+}
+
+func TestStatInterrupt(t *testing.T) {
+	st := newTestPpuState()
+	st.mem[0xFF45] = 3        // LYC
+	st.writeMem(0xFF41, 0x40) // LYC=LY interrupt
+	statRequested := func() bool {
+		return getBit(st.mem[0xFF0F], 1)
+	}
+
+	for st.ppu.ly != 3 {
+		st.stepPpu()
+	}
+	if !statRequested() {
+		t.Fatalf(`Expected a LYC=LY interrupt.`)
+	}
+	if STAT := st.readMem(0xFF41); STAT != 0xC6 {
+		t.Fatalf(`Expected STAT=0xC6, got 0x%02X.`, STAT)
+	}
+
+	// The H-Blank of line 3 doesn't trigger an interrupt since the line is already high.
+	st.mem[0xFF0F] = 0x00
+	st.writeMem(0xFF41, 0x48) // LYC=LY and H-Blank interrupts
+	for st.ppu.ly != 4 {
+		st.stepPpu()
+	}
+	if statRequested() {
+		t.Fatalf(`Unexpected STAT interrupt.`)
+	}
+
+	for st.ppu.mode != modeHBlank {
+		st.stepPpu()
+	}
+	if !statRequested() {
+		t.Fatalf(`Expected a H-Blank interrupt.`)
+	}
+}
+
+func TestLcdModes(t *testing.T) {
+	st := newTestPpuState()
+	st.mem[0xFF45] = 1 // LYC
+	stepPpu := func(n int) {
+		for i := 0; i < n; i++ {
+			st.stepPpu()
+		}
+	}
+	expectStat := func(ly u8, STAT u8, context string) {
+		if actual := st.readMem(0xFF44); actual != ly {
+			t.Fatalf(`%s: expected LY=%d, got %d.`, context, ly, actual)
+		}
+		if actual := st.readMem(0xFF41); actual != STAT {
+			t.Fatalf(`%s: expected STAT=0x%02X, got 0x%02X.`, context, STAT, actual)
+		}
+	}
+
+	stepPpu(1) // The LCD is turned on.
+	expectStat(0, 0x80|modeOamSearch, "dot 0")
+	stepPpu(79)
+	expectStat(0, 0x80|modeOamSearch, "dot 79")
+	stepPpu(1)
+	expectStat(0, 0x80|modePixelTransfer, "dot 80")
+	stepPpu(171)
+	expectStat(0, 0x80|modePixelTransfer, "dot 251")
+	stepPpu(1)
+	expectStat(0, 0x80|modeHBlank, "dot 252")
+	stepPpu(203)
+	expectStat(0, 0x80|modeHBlank, "dot 455")
+	stepPpu(1)
+	expectStat(1, 0x84|modeOamSearch, "line 1") // LYC=LY
+
+	stepPpu(143 * dotsPerLine)
+	expectStat(144, 0x80|modeVBlank, "line 144")
+	if !st.ppu.frameReady {
+		t.Fatalf(`Expected the frame to be ready at the start of V-Blank.`)
+	}
+	stepPpu(10 * dotsPerLine)
+	expectStat(0, 0x80|modeOamSearch, "next frame")
+}
+
+func TestMidFrameScroll(t *testing.T) {
+	st := newTestPpuState()
+	// The second column of the background is color 3.
+	for row := u16(0); row < 32; row++ {
+		st.mem[0x9800+row*32+1] = 0x01
+	}
+
+	// Turn the LCD on and draw the first 10 lines.
+	for i := 0; i < 1+10*dotsPerLine; i++ {
+		st.stepPpu()
+	}
+	st.writeMem(0xFF43, 8) // SCX
+	for !st.ppu.frameReady {
+		st.stepPpu()
+	}
+
+	expectLine(t, st, 0, map[int]u8{0: 0, 8: 3})
+	expectLine(t, st, 9, map[int]u8{0: 0, 8: 3})
+	expectLine(t, st, 10, map[int]u8{0: 3, 8: 0})
+	expectLine(t, st, 143, map[int]u8{0: 3, 8: 0})
+}
+
+func TestBackgroundDisabled(t *testing.T) {
+	st := newTestPpuState()
+	st.mem[0xFF40] &^= 0x01 // BG off
+	st.mem[0xFF47] = 0xFF   // BGP: All black
+	st.drawLine()
+	expectLine(t, st, 0, map[int]u8{0: 0, 80: 0, 159: 0})
+}
@@ -35,11 +35,14 @@ import (
 )
 
 const FILE_FMT = "%d.png"
+const AUDIO_FILE = "audio.wav"
 
 type recorder struct {
 	wg          *sync.WaitGroup
 	frameNumber int
-	tmpDir      string // The directory for the pngs.
+	tmpDir      string // The directory for the pngs and the audio.
+	audio       *wavWriter
+	audioSizes  []int  // The number of samples added after each frame.
 	dstFile     string // The mp4.
 }
 
@@ -55,6 +58,7 @@ func newRecorder() *recorder {
 		wg:          &wg,
 		frameNumber: 0,
 		tmpDir:      tmpDir,
+		audio:       newWavWriter(filepath.Join(tmpDir, AUDIO_FILE)),
 		dstFile:     prefix + ".mp4",
 	}
 }
@@ -88,18 +92,43 @@ func (recorder *recorder) addFrame(frame [144][160]u32) {
 	recorder.frameNumber++
 }
 
+// samples are the APU samples of the last frame, interleaved left and right.
+func (recorder *recorder) addAudio(samples []float32) {
+	recorder.audio.write(samples)
+	recorder.audioSizes = append(recorder.audioSizes, len(samples))
+}
+
+// For the rewind, removes the last frame and its audio.
+func (recorder *recorder) removeLastFrame() {
+	if recorder.frameNumber == 0 {
+		return
+	}
+	recorder.wg.Wait()
+
+	recorder.frameNumber--
+	filename := filepath.Join(recorder.tmpDir, fmt.Sprintf(FILE_FMT, recorder.frameNumber))
+	err := os.Remove(filename)
+	check(err)
+
+	if n := len(recorder.audioSizes); n > 0 {
+		recorder.audio.truncate(recorder.audioSizes[n-1])
+		recorder.audioSizes = recorder.audioSizes[:n-1]
+	}
+}
+
 func (recorder *recorder) close() {
 	recorder.wg.Wait()
+	recorder.audio.close()
 
-	// 4.194304 MHz, 154 * 456 cycles per frame
-	const framerate = 4.194304 * 1000000. / (154. * 456.)
-	assert(59.70 <= framerate && framerate <= 59.75)
+	assert(59.70 <= frameRate && frameRate <= 59.75)
 
 	argv := []string{
 		"ffmpeg",
-		"-r", fmt.Sprint(framerate), // The input framerate.
+		"-r", fmt.Sprint(frameRate), // The input framerate.
 		"-i", filepath.Join(recorder.tmpDir, FILE_FMT), // The input images.
+		"-i", filepath.Join(recorder.tmpDir, AUDIO_FILE), // The input audio.
 		"-pix_fmt", "yuv420p", // Makes the video playable in web browsers.
+		"-c:a", "aac", // Mp4 doesn't support PCM audio.
 		"-y",             // Overwrite the destination file if it exists.
 		recorder.dstFile, // The destination file.
 	}
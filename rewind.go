@@ -0,0 +1,106 @@
+/*
+ * gammaboy is a Game Boy emulator.
+ * Copyright (C) 2018  gammpei
+ *
+ * This file is part of gammaboy.
+ *
+ * gammaboy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * gammaboy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with gammaboy.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+)
+
+// The snapshots of the last frames, to go back in time.
+// We keep the newest snapshot as is, and the older ones as the compressed XOR with the next one:
+// most of the state doesn't change from one frame to the next, so the deltas compress well.
+type rewindBuffer struct {
+	maxSize int  // In bytes.
+	size    int  // The total size of current and the deltas.
+	current []u8 // The newest snapshot, nil if the buffer is empty.
+	deltas  [][]u8
+}
+
+func newRewindBuffer(maxSize int) *rewindBuffer {
+	return &rewindBuffer{
+		maxSize: maxSize,
+		size:    0,
+		current: nil,
+		deltas:  nil,
+	}
+}
+
+func xorBytes(a, b []u8) []u8 {
+	assert(len(a) == len(b))
+	x := make([]u8, len(a))
+	for i := range a {
+		x[i] = a[i] ^ b[i]
+	}
+	return x
+}
+
+func (rewind *rewindBuffer) push(st *st) {
+	snapshot := st.saveState()
+	if rewind.current != nil {
+		var compressed bytes.Buffer
+		writer, err := flate.NewWriter(&compressed, flate.BestSpeed)
+		check(err)
+		_, err = writer.Write(xorBytes(snapshot, rewind.current))
+		check(err)
+		check(writer.Close())
+
+		rewind.deltas = append(rewind.deltas, compressed.Bytes())
+		rewind.size += compressed.Len() - len(rewind.current)
+	}
+	rewind.current = snapshot
+	rewind.size += len(snapshot)
+
+	// Forget the oldest snapshots.
+	for rewind.size > rewind.maxSize && len(rewind.deltas) > 0 {
+		rewind.size -= len(rewind.deltas[0])
+		rewind.deltas[0] = nil
+		rewind.deltas = rewind.deltas[1:]
+	}
+}
+
+// Loads the newest snapshot and forgets it.
+// Returns false if there are no snapshots left.
+func (rewind *rewindBuffer) pop(st *st) bool {
+	if rewind.current == nil {
+		return false
+	}
+	err := st.loadState(rewind.current)
+	check(err)
+
+	rewind.size -= len(rewind.current)
+	if len(rewind.deltas) == 0 {
+		rewind.current = nil
+		return true
+	}
+
+	last := len(rewind.deltas) - 1
+	delta, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(rewind.deltas[last])))
+	check(err)
+	rewind.size -= len(rewind.deltas[last])
+	rewind.deltas[last] = nil
+	rewind.deltas = rewind.deltas[:last]
+
+	rewind.current = xorBytes(rewind.current, delta)
+	rewind.size += len(rewind.current)
+	return true
+}
@@ -0,0 +1,80 @@
+/*
+ * gammaboy is a Game Boy emulator.
+ * Copyright (C) 2018  gammpei
+ *
+ * This file is part of gammaboy.
+ *
+ * gammaboy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * gammaboy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with gammaboy.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRewindBuffer(t *testing.T) {
+	st := newState(newBankedRom(0x00 /*ROM ONLY*/, 2, 0x00 /*None*/), nil /*linkCable*/, false /*useWallClock*/)
+	rewind := newRewindBuffer(1024 * 1024)
+
+	var snapshots [][]u8
+	for i := 0; i < 10; i++ {
+		st.writeMem(0xC000+u16(i), u8(i+1))
+		st.addCycles(1000)
+		rewind.push(st)
+		snapshots = append(snapshots, st.saveState())
+	}
+
+	for i := 9; i >= 0; i-- {
+		if !rewind.pop(st) {
+			t.Fatalf("Expected snapshot %d to be in the buffer.", i)
+		}
+		if !bytes.Equal(st.saveState(), snapshots[i]) {
+			t.Fatalf("Snapshot %d is different.", i)
+		}
+	}
+	if rewind.pop(st) {
+		t.Fatalf("Expected the buffer to be empty.")
+	}
+	if rewind.size != 0 {
+		t.Fatalf("Expected a size of 0, got %d.", rewind.size)
+	}
+}
+
+func TestRewindBufferMaxSize(t *testing.T) {
+	st := newState(newBankedRom(0x00 /*ROM ONLY*/, 2, 0x00 /*None*/), nil /*linkCable*/, false /*useWallClock*/)
+	maxSize := 2 * len(st.saveState())
+	rewind := newRewindBuffer(maxSize)
+
+	for i := 0; i < 1000; i++ {
+		// Incompressible changes.
+		for addr := u16(0xC000); addr < 0xC100; addr++ {
+			st.writeMem(addr, u8(addr)*u8(i)^u8(i>>3))
+		}
+		st.addCycles(1000)
+		rewind.push(st)
+		if rewind.size > maxSize {
+			t.Fatalf("Expected at most %d bytes, got %d.", maxSize, rewind.size)
+		}
+	}
+
+	n := 0
+	for rewind.pop(st) {
+		n++
+	}
+	if n < 2 || n == 1000 {
+		t.Fatalf("Expected some of the snapshots to be forgotten, got %d.", n)
+	}
+}
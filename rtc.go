@@ -0,0 +1,220 @@
+/*
+ * gammaboy is a Game Boy emulator.
+ * Copyright (C) 2018  gammpei
+ *
+ * This file is part of gammaboy.
+ *
+ * gammaboy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * gammaboy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with gammaboy.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// A monotonic time source for the real-time clock.
+// Only the differences between two calls matter.
+// A nil rtcClock stands for the wall time.
+type rtcClock func() time.Duration
+
+func wallTime() time.Duration {
+	return time.Duration(time.Now().UnixNano())
+}
+
+// The real-time clock of MBC3 cartridges.
+type rtc struct {
+	clock      rtcClock
+	lastTime   time.Duration // The time of the last update.
+	subSeconds time.Duration // The time elapsed since the last second tick.
+
+	seconds u8  // 0x08: RTC S
+	minutes u8  // 0x09: RTC M
+	hours   u8  // 0x0A: RTC H
+	days    u16 // 0x0B: RTC DL, and bit 0 of 0x0C: RTC DH
+	halt    bool
+	carry   bool // Day counter carry
+
+	latched  [5]u8 // The registers 0x08-0x0C as of the last latch.
+	latchReg u8    // The last value written to 0x6000-0x7FFF.
+}
+
+func newRtc(clock rtcClock) *rtc {
+	rtc := &rtc{
+		clock:    clock,
+		latchReg: 0xFF,
+	}
+	rtc.lastTime = rtc.now()
+	rtc.latched = rtc.registers()
+	return rtc
+}
+
+func (rtc *rtc) now() time.Duration {
+	if rtc.clock == nil {
+		return wallTime()
+	}
+	return rtc.clock()
+}
+
+// Catches up with the clock source.
+func (rtc *rtc) update() {
+	now := rtc.now()
+	elapsed := now - rtc.lastTime
+	rtc.lastTime = now
+	if rtc.halt || elapsed <= 0 {
+		return
+	}
+
+	rtc.subSeconds += elapsed
+	rtc.tick(u64(rtc.subSeconds / time.Second))
+	rtc.subSeconds %= time.Second
+}
+
+// Advances the counters by n seconds.
+func (rtc *rtc) tick(n u64) {
+	s := u64(rtc.seconds) + n
+	rtc.seconds = u8(s % 60)
+	m := u64(rtc.minutes) + s/60
+	rtc.minutes = u8(m % 60)
+	h := u64(rtc.hours) + m/60
+	rtc.hours = u8(h % 24)
+	d := u64(rtc.days) + h/24
+	if d > 0x1FF {
+		// The carry stays set until the game clears it.
+		rtc.carry = true
+	}
+	rtc.days = u16(d % 0x200)
+}
+
+// The current values of the registers 0x08-0x0C.
+func (rtc *rtc) registers() [5]u8 {
+	DH := u8(rtc.days>>8) & 0x01
+	DH = setBit(DH, 6, rtc.halt)
+	DH = setBit(DH, 7, rtc.carry)
+	return [5]u8{rtc.seconds, rtc.minutes, rtc.hours, u8(rtc.days), DH}
+}
+
+// The game only sees the latched registers.
+func (rtc *rtc) read(reg u8) u8 {
+	assert(0x08 <= reg && reg <= 0x0C)
+	return rtc.latched[reg-0x08]
+}
+
+func (rtc *rtc) write(reg u8, value u8) {
+	assert(0x08 <= reg && reg <= 0x0C)
+	rtc.update()
+
+	rtc.setRegister(reg, value)
+	if reg == 0x08 {
+		// Writing the seconds resets the sub-second counter.
+		rtc.subSeconds = 0
+	}
+
+	// Writes are visible without having to latch again.
+	rtc.latched[reg-0x08] = rtc.registers()[reg-0x08]
+}
+
+func (rtc *rtc) setRegister(reg u8, value u8) {
+	switch reg {
+	case 0x08: // RTC S
+		rtc.seconds = value & 0x3F
+	case 0x09: // RTC M
+		rtc.minutes = value & 0x3F
+	case 0x0A: // RTC H
+		rtc.hours = value & 0x1F
+	case 0x0B: // RTC DL
+		rtc.days = rtc.days&0x100 | u16(value)
+	case 0x0C: // RTC DH
+		rtc.days = rtc.days&0x0FF | u16(value&0x01)<<8
+		rtc.halt = getBit(value, 6)
+		rtc.carry = getBit(value, 7)
+	default:
+		assert(false)
+	}
+}
+
+// Writing 0x00 then 0x01 to 0x6000-0x7FFF latches the current time.
+func (rtc *rtc) writeLatch(value u8) {
+	if rtc.latchReg == 0x00 && value == 0x01 {
+		rtc.update()
+		rtc.latched = rtc.registers()
+	}
+	rtc.latchReg = value
+}
+
+// The RTC footer of .sav files in the format used by VBA-M and BGB:
+// the registers then the latched registers as u32s, followed by a u64 unix timestamp.
+const rtcSaveDataSize = 48
+
+func (rtc *rtc) saveData(timestamp time.Time) []u8 {
+	rtc.update()
+
+	data := make([]u8, rtcSaveDataSize)
+	registers := rtc.registers()
+	if timestamp.Equal(noTimestamp) && rtc.clock == nil {
+		// To compare the save data, the counters are left out since they tick every second.
+		// With the wall time, the timestamp is enough to restore them.
+		// The emulated time doesn't run while the emulator is off, so it has to be saved.
+		registers = [5]u8{0x00, 0x00, 0x00, 0x00, registers[4] & 0x40}
+	}
+	for i := 0; i < 5; i++ {
+		binary.LittleEndian.PutUint32(data[i*4:], u32(registers[i]))
+		binary.LittleEndian.PutUint32(data[20+i*4:], u32(rtc.latched[i]))
+	}
+	binary.LittleEndian.PutUint64(data[40:], u64(timestamp.Unix()))
+	return data
+}
+
+func (rtc *rtc) loadSaveData(data []u8) {
+	// Some emulators write a 32-bit timestamp.
+	assert(len(data) == rtcSaveDataSize || len(data) == rtcSaveDataSize-4)
+
+	for i := 0; i < 5; i++ {
+		rtc.setRegister(u8(0x08+i), u8(binary.LittleEndian.Uint32(data[i*4:])))
+		rtc.latched[i] = u8(binary.LittleEndian.Uint32(data[20+i*4:]))
+	}
+	var timestamp int64
+	if len(data) == rtcSaveDataSize {
+		timestamp = int64(binary.LittleEndian.Uint64(data[40:]))
+	} else {
+		timestamp = int64(binary.LittleEndian.Uint32(data[40:]))
+	}
+
+	rtc.lastTime = rtc.now()
+	rtc.subSeconds = 0
+
+	// The wall clock kept ticking while the emulator was off.
+	// The emulated time didn't.
+	if rtc.clock == nil && !rtc.halt {
+		elapsed := time.Now().Unix() - timestamp
+		if elapsed > 0 {
+			rtc.tick(u64(elapsed))
+		}
+	}
+}
+
+// With the wall time, the clock catches up with the time elapsed since the save state.
+func (rtc *rtc) sync(s *serializer) {
+	s.duration(&rtc.lastTime)
+	s.duration(&rtc.subSeconds)
+	s.u8(&rtc.seconds)
+	s.u8(&rtc.minutes)
+	s.u8(&rtc.hours)
+	s.u16(&rtc.days)
+	s.bool(&rtc.halt)
+	s.bool(&rtc.carry)
+	s.bytes(rtc.latched[:])
+	s.u8(&rtc.latchReg)
+}
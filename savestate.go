@@ -0,0 +1,211 @@
+/*
+ * gammaboy is a Game Boy emulator.
+ * Copyright (C) 2018  gammpei
+ *
+ * This file is part of gammaboy.
+ *
+ * gammaboy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * gammaboy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with gammaboy.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A save state file is the magic, the version, the SHA-256 hash of the rom (in hex),
+// then the fields of the state in the order of the sync methods.
+const saveStateMagic = "GMBYSTATE"
+
+// To increment whenever a sync method changes.
+const saveStateVersion = 4
+
+// Reads or writes the fields of a save state, so that each sync method describes both directions.
+type serializer struct {
+	saving bool
+	writer *bytes.Buffer // When saving, nil to only count the size.
+	reader *bytes.Reader // When loading.
+	size   int           // The number of bytes saved or loaded.
+}
+
+func (s *serializer) bytes(x []u8) {
+	s.size += len(x)
+	if s.saving {
+		if s.writer != nil {
+			s.writer.Write(x)
+		}
+	} else {
+		_, err := io.ReadFull(s.reader, x)
+		check(err)
+	}
+}
+
+func (s *serializer) u8(x *u8) {
+	b := []u8{*x}
+	s.bytes(b)
+	*x = b[0]
+}
+
+func (s *serializer) u16(x *u16) {
+	b := make([]u8, 2)
+	binary.LittleEndian.PutUint16(b, *x)
+	s.bytes(b)
+	*x = binary.LittleEndian.Uint16(b)
+}
+
+func (s *serializer) u32(x *u32) {
+	b := make([]u8, 4)
+	binary.LittleEndian.PutUint32(b, *x)
+	s.bytes(b)
+	*x = binary.LittleEndian.Uint32(b)
+}
+
+func (s *serializer) u64(x *u64) {
+	b := make([]u8, 8)
+	binary.LittleEndian.PutUint64(b, *x)
+	s.bytes(b)
+	*x = binary.LittleEndian.Uint64(b)
+}
+
+func (s *serializer) int(x *int) {
+	y := u64(*x)
+	s.u64(&y)
+	*x = int(y)
+}
+
+func (s *serializer) bool(x *bool) {
+	y := u8FromBool(*x)
+	s.u8(&y)
+	*x = y != 0
+}
+
+func (s *serializer) float32(x *float32) {
+	y := math.Float32bits(*x)
+	s.u32(&y)
+	*x = math.Float32frombits(y)
+}
+
+func (s *serializer) duration(x *time.Duration) {
+	y := u64(*x)
+	s.u64(&y)
+	*x = time.Duration(y)
+}
+
+// The pressed buttons aren't included, they come from the host.
+func (st *st) sync(s *serializer) {
+	for i := range st.regs {
+		s.u16(&st.regs[i])
+	}
+	s.bytes(st.mem[:])
+	s.u64(&st.timing.cycles)
+	s.u16(&st.timing.systemClock)
+	s.bool(&st.timing.delayedTimerBit)
+	s.bool(&st.timing.oddCycle)
+	st.ppu.sync(s)
+	st.apu.sync(s)
+	st.dma.sync(s)
+	s.bool(&st.biosIsEnabled)
+	s.bool(&st.IME)
+	s.bool(&st.halted)
+	s.bool(&st.haltBug)
+	s.bool(&st.stopped)
+	s.bool(&st.doubleSpeed)
+	st.mbc.sync(s)
+}
+
+func (st *st) saveState() []u8 {
+	s := &serializer{saving: true, writer: &bytes.Buffer{}}
+	s.bytes([]u8(saveStateMagic))
+	version := u16(saveStateVersion)
+	s.u16(&version)
+	s.bytes([]u8(st.romHash))
+	st.sync(s)
+	return s.writer.Bytes()
+}
+
+// The size only depends on the rom.
+func (st *st) saveStateSize() int {
+	s := &serializer{saving: true, writer: nil}
+	st.sync(s)
+	return len(saveStateMagic) + 2 + len(st.romHash) + s.size
+}
+
+func (st *st) loadState(data []u8) error {
+	s := &serializer{saving: false, reader: bytes.NewReader(data)}
+	header := make([]u8, len(saveStateMagic)+2+64)
+	if _, err := io.ReadFull(s.reader, header); err != nil {
+		return fmt.Errorf("Not a save state.")
+	}
+	if string(header[:len(saveStateMagic)]) != saveStateMagic {
+		return fmt.Errorf("Not a save state.")
+	}
+	header = header[len(saveStateMagic):]
+	if version := binary.LittleEndian.Uint16(header); version != saveStateVersion {
+		return fmt.Errorf("Unsupported save state version %d.", version)
+	}
+	if hash := string(header[2:]); hash != st.romHash {
+		return fmt.Errorf("The save state is for another rom (SHA-256 %s).", hash)
+	}
+	// So that a truncated file can't leave us with a half loaded state.
+	if len(data) != st.saveStateSize() {
+		return fmt.Errorf("The save state is corrupted.")
+	}
+
+	st.sync(s)
+	st.apu.samples = nil
+	return nil
+}
+
+// game.gb -> game.ss0 to game.ss9
+func saveStatePath(romPath string, slot int) string {
+	return fmt.Sprintf("%s.ss%d", strings.TrimSuffix(romPath, filepath.Ext(romPath)), slot)
+}
+
+func (gb *gameBoy) saveStateSlot(slot int) {
+	if gb.romPath == "" {
+		return
+	}
+	path := saveStatePath(gb.romPath, slot)
+	err := ioutil.WriteFile(path, gb.st.saveState(), 0644)
+	check(err)
+	fmt.Printf("Saved %s\n", path)
+}
+
+func (gb *gameBoy) loadStateSlot(slot int) {
+	if gb.romPath == "" {
+		return
+	}
+	path := saveStatePath(gb.romPath, slot)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		fmt.Printf("No save state in slot %d.\n", slot)
+		return
+	}
+	check(err)
+
+	if err := gb.st.loadState(data); err != nil {
+		fmt.Printf("Could not load %s: %v\n", path, err)
+		return
+	}
+	fmt.Printf("Loaded %s\n", path)
+}
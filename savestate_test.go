@@ -0,0 +1,78 @@
+/*
+ * gammaboy is a Game Boy emulator.
+ * Copyright (C) 2018  gammpei
+ *
+ * This file is part of gammaboy.
+ *
+ * gammaboy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * gammaboy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with gammaboy.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSaveState(t *testing.T) {
+	rom := newBankedRom(0x10 /*MBC3+TIMER+RAM+BATTERY*/, 8, 0x03 /*32 KiB*/)
+	st := newState(rom, nil /*linkCable*/, false /*useWallClock*/)
+	st.biosIsEnabled = false
+	st.writeMem(0x0000, 0x0A) // Enable the ram and the timer.
+	st.writeMem(0x2000, 0x05) // Rom bank 5
+	st.writeMem(0x4000, 0x02) // Ram bank 2
+	st.writeMem(0xA123, 0x42)
+	st.writeMem(0xC000, 0x24)
+	st.writeMem(0xFF26, 0x80) // NR52: Sound on
+	st.writeMem(0xFF40, 0x91) // LCDC: LCD on
+	PC.set(st, 0x1234)
+	st.addCycles(12345)
+
+	saved := st.saveState()
+	if size := st.saveStateSize(); size != len(saved) {
+		t.Fatalf("Expected a save state size of %d, got %d.", len(saved), size)
+	}
+
+	// Change everything.
+	st.writeMem(0x2000, 0x01)
+	st.writeMem(0x4000, 0x00)
+	st.writeMem(0xA123, 0x00)
+	st.writeMem(0xC000, 0x00)
+	PC.set(st, 0x0000)
+	st.addCycles(54321)
+
+	if err := st.loadState(saved); err != nil {
+		t.Fatalf("Could not load the save state: %v", err)
+	}
+	expectRead(t, "Rom bank", st.readMem(0x4000), 0x05)
+	expectRead(t, "Ram bank", st.readMem(0xA123), 0x42)
+	expectRead(t, "Work ram", st.readMem(0xC000), 0x24)
+	if pc := PC.get(st); pc != 0x1234 {
+		t.Fatalf("Expected PC=0x1234, got 0x%04X.", pc)
+	}
+	if !bytes.Equal(st.saveState(), saved) {
+		t.Fatalf("The reloaded state is different.")
+	}
+
+	other := newState(newBankedRom(0x10 /*MBC3+TIMER+RAM+BATTERY*/, 4, 0x03 /*32 KiB*/), nil, false)
+	if err := other.loadState(saved); err == nil {
+		t.Fatalf("Expected an error when loading a save state of another rom.")
+	}
+	if err := st.loadState(saved[:len(saved)-1]); err == nil {
+		t.Fatalf("Expected an error when loading a truncated save state.")
+	}
+	if err := st.loadState([]u8("garbage")); err == nil {
+		t.Fatalf("Expected an error when loading garbage.")
+	}
+}
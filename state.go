@@ -20,55 +20,112 @@
 
 package main
 
+import (
+	"time"
+)
+
 // The state of the emulator.
 type state struct {
 	regs [6]u16
 	mem  [0xFFFF + 1]u8
 
 	timing struct {
-		// The number of elapsed clock cycles since powerup.
+		// The number of elapsed clock cycles since powerup (at the normal speed).
 		// At 4.194304 MHz, a u64 is enough for 139 365 years...
 		// Needless to say I'll let other people deal with that overflow bug...
 		cycles      u64
 		systemClock u16
 		// The delayed system clock bit for the timer.
 		delayedTimerBit bool
+		// The cycles already spent in the current instruction.
+		instrCycles int
+		// In double speed, the PPU and the APU skip every other cycle.
+		oddCycle bool
 	}
 
+	// The immediate operands of the current instruction, fetched during the decoding.
+	immediate [2]u8
+
+	ppu     ppu
+	apu     apu
+	dma     dma
+	buttons u8 // The pressed buttons of the joypad.
+
 	biosIsEnabled bool
 	IME           bool // Interrupt Master Enable
+	halted        bool // Until an interrupt is pending.
+	haltBug       bool
+	stopped       bool // Until a button is pressed, the whole system is stopped.
+
+	// We emulate a DMG, but CGB cartridges can still switch to double speed with KEY1 and STOP.
+	cgb         bool
+	doubleSpeed bool
 
 	rom       []u8
+	romHash   string // SHA-256, for the save states.
+	mbc       mbc
 	linkCable chan u8
+	rumble    rumbleHook // Installed by the frontend, can be nil.
 }
 type st = state
 
-func newState(rom []u8, linkCable chan u8) *st {
-	assert(len(rom) == 0x7FFF+1)
+const clockFrequency = 4194304 // Hz
 
-	return &st{
+func newState(rom []u8, linkCable chan u8, useWallClock bool) *st {
+	st := &st{
 		timing: struct {
 			cycles          u64
 			systemClock     u16
 			delayedTimerBit bool
+			instrCycles     int
+			oddCycle        bool
 		}{
 			cycles:          0,
 			systemClock:     0x0000,
 			delayedTimerBit: false,
+			instrCycles:     0,
+			oddCycle:        false,
 		},
 
+		apu: newApu(),
+
 		biosIsEnabled: true,
 		IME:           false, // 0 at startup since the bios is mapped over the interrupt vector table.
 
+		cgb:         getBit(rom[0x0143], 7), // CGB flag
+		doubleSpeed: false,
+
 		rom:       rom,
+		romHash:   sha256Hash(rom),
 		linkCable: linkCable,
+		rumble:    nil,
 	}
+
+	var clock rtcClock = nil // The wall time.
+	if !useWallClock {
+		clock = st.emulatedTime
+	}
+	st.mbc = newMbc(rom, clock, st.setMotor)
+
+	return st
+}
+
+// The motor of rumble cartridges.
+func (st *st) setMotor(motor bool) {
+	if st.rumble != nil {
+		st.rumble(motor)
+	}
+}
+
+// The emulated time since powerup.
+func (st *st) emulatedTime() time.Duration {
+	const freq = clockFrequency
+	cycles := st.timing.cycles
+	return time.Duration(cycles/freq)*time.Second + time.Duration(cycles%freq)*time.Second/freq
 }
 
 func (st *st) addCycles(cycles int) {
 	for i := 0; i < cycles; i++ {
-		st.timing.cycles++
-
 		// Update timer.
 		st.timing.systemClock++
 		TAC := st.readMem(0xFF07) // TAC: Timer control
@@ -87,5 +144,18 @@ func (st *st) addCycles(cycles int) {
 			st.writeMem(0xFF05, TIMA)
 		}
 		st.timing.delayedTimerBit = timerBit
+
+		st.stepDma()
+
+		// In double speed, the CPU, the timer and the DMA run twice as fast, but not the PPU and the APU.
+		if st.doubleSpeed {
+			st.timing.oddCycle = !st.timing.oddCycle
+			if st.timing.oddCycle {
+				continue
+			}
+		}
+		st.timing.cycles++
+		st.stepPpu()
+		st.stepApu()
 	}
 }
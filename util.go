@@ -23,6 +23,7 @@ package main
 import (
 	"crypto/sha256"
 	"fmt"
+	"os"
 	"time"
 )
 
@@ -38,7 +39,7 @@ func sha256Hash(x []u8) string {
 
 func stopWatch(s string, start time.Time) {
 	elapsed := time.Since(start)
-	fmt.Printf("%s: %.3fs\n", s, elapsed.Seconds())
+	fmt.Fprintf(os.Stderr, "%s: %.3fs\n", s, elapsed.Seconds())
 }
 
 func getBit(x u8, bit uint) bool {
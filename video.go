@@ -27,17 +27,40 @@ import (
 )
 
 type gui struct {
-	window   *sdl.Window
-	renderer *sdl.Renderer
-	texture  *sdl.Texture
-	palette  [4]u32
-	recorder *recorder
+	title       string
+	window      *sdl.Window
+	renderer    *sdl.Renderer
+	texture     *sdl.Texture
+	palette     [4]u32
+	recorder    *recorder
+	audio       *audio // nil if there is no audio device.
+	limiter     *frameLimiter
+	keyBindings map[sdl.Keycode]string
+
+	// The pressed buttons of the joypad.
+	keyboardButtons u8
+	controllers     map[sdl.JoystickID]*controller
+	motor           bool // The motor of rumble cartridges, sent to the controllers.
+
+	// The hotkeys.
+	paused       bool
+	frameAdvance bool // Run one frame while paused.
+	fastForward  bool // While held.
+	slowMotion   bool
+
+	rewinding bool // While held.
+	// The frame comes from the rewind buffer, it was already recorded.
+	rewound bool
+
+	stateSlot          int // 0-9
+	saveStateRequested bool
+	loadStateRequested bool
 }
 
 func newGui(title string) *gui {
 	defer stopWatch("newGui", time.Now())
 
-	err := sdl.Init(sdl.INIT_VIDEO)
+	err := sdl.Init(sdl.INIT_VIDEO | sdl.INIT_AUDIO | sdl.INIT_GAMECONTROLLER)
 	check(err)
 
 	window, err := sdl.CreateWindow(
@@ -51,11 +74,19 @@ func newGui(title string) *gui {
 
 	renderer, err := sdl.CreateRenderer(
 		window,
-		-1,     // index of the rendering driver
-		0x0000, // flags
+		-1,                        // index of the rendering driver
+		sdl.RENDERER_PRESENTVSYNC, // flags
 	)
 	check(err)
 
+	// 0 if unknown.
+	refreshRate := 0
+	if displayIndex, err := window.GetDisplayIndex(); err == nil {
+		if mode, err := sdl.GetCurrentDisplayMode(displayIndex); err == nil {
+			refreshRate = int(mode.RefreshRate)
+		}
+	}
+
 	assert(sdl.SetHint(sdl.HINT_RENDER_SCALE_QUALITY, flags.scalingAlg))
 	err = renderer.SetLogicalSize(160, 144)
 	check(err)
@@ -98,12 +129,34 @@ func newGui(title string) *gui {
 		recorder = newRecorder()
 	}
 
+	audio := newAudio()
+
 	return &gui{
-		window:   window,
-		renderer: renderer,
-		texture:  texture,
-		palette:  palette,
-		recorder: recorder,
+		title:       title,
+		window:      window,
+		renderer:    renderer,
+		texture:     texture,
+		palette:     palette,
+		recorder:    recorder,
+		audio:       audio,
+		limiter:     newFrameLimiter(refreshRate, audio != nil),
+		keyBindings: loadKeyBindings(flags.keys),
+
+		keyboardButtons: 0x00,
+		controllers:     map[sdl.JoystickID]*controller{},
+		motor:           false,
+
+		paused:       false,
+		frameAdvance: false,
+		fastForward:  false,
+		slowMotion:   false,
+
+		rewinding: false,
+		rewound:   false,
+
+		stateSlot:          0,
+		saveStateRequested: false,
+		loadStateRequested: false,
 	}
 }
 
@@ -111,27 +164,17 @@ func (gui *gui) drawFrame(st *st) {
 	var screen [144][160]u32
 	for y := 0; y < 144; y++ {
 		for x := 0; x < 160; x++ {
-			screen[y][x] = gui.palette[0] // White
-		}
-	}
-
-	LCDC := st.readMem(0xFF40) // LCD Control
-	lcdDisplayEnable := getBit(LCDC, 7)
-	if lcdDisplayEnable {
-		bgDisplayEnable := getBit(LCDC, 0)
-		if bgDisplayEnable {
-			gui.drawBackground(st, &screen)
-		}
-
-		windowDisplayEnable := getBit(LCDC, 5)
-		if windowDisplayEnable {
-			panic("TODO")
+			shade := st.ppu.frame[y][x]
+			screen[y][x] = gui.palette[shade]
 		}
 	}
 
-	if gui.recorder != nil {
+	if gui.recorder != nil && !gui.rewound {
 		gui.recorder.addFrame(screen)
 	}
+	if !gui.limiter.shouldPresent(gui.speed()) {
+		return
+	}
 
 	const pitch = 160 * 4
 	err := gui.texture.Update(
@@ -151,85 +194,14 @@ func (gui *gui) drawFrame(st *st) {
 	gui.renderer.Present()
 }
 
-func (gui *gui) drawBackground(st *st, screen *[144][160]u32) {
-	LCDC := st.readMem(0xFF40) // LCD Control
-
-	var bgTileMap u16
-	switch getBit(LCDC, 3) {
-	case false:
-		bgTileMap = 0x9800 // 0x9800-0x9BFF
-	case true:
-		bgTileMap = 0x9C00 // 0x9C00-0x9FFF
+// samples are the APU samples of the frame, interleaved left and right.
+func (gui *gui) playAudio(samples []float32) {
+	if gui.recorder != nil && !gui.rewound {
+		gui.recorder.addAudio(samples)
 	}
-
-	var tileSet u16
-	switch getBit(LCDC, 4) {
-	case false:
-		tileSet = 0x8800 // 0x8800-0x97FF
-	case true:
-		tileSet = 0x8000 // 0x8000-0x8FFF
-	}
-
-	BGP := st.readMem(0xFF47) // BackGround Palette
-	var palette [4]u32
-	for i, _ := range palette {
-		colorIndex := (BGP >> uint(i*2)) & 0x03
-		palette[i] = gui.palette[colorIndex]
-	}
-
-	var bg [256][256]u32
-	for tileMapY := 0; tileMapY < 32; tileMapY++ {
-		for tileMapX := 0; tileMapX < 32; tileMapX++ {
-			tileMapIndex := tileMapY*32 + tileMapX
-
-			tileSetIndex := st.readMem(bgTileMap + u16(tileMapIndex))
-			switch tileSet {
-			case 0x8000:
-			case 0x8800:
-				tileSetIndex = u8(int(i8(tileSetIndex)) + 128)
-			default:
-				assert(false)
-			}
-
-			for tileY := 0; tileY < 8; tileY++ {
-				lineAddr := tileSet + u16(int(tileSetIndex)*16+tileY*2)
-				lowBits := st.readMem(lineAddr)
-				highBits := st.readMem(lineAddr + 1)
-
-				for tileX := 0; tileX < 8; tileX++ {
-					bit := uint(7 - tileX)
-					l := getBit(lowBits, bit)
-					h := getBit(highBits, bit)
-
-					var paletteIndex int
-					switch {
-					case !h && !l:
-						paletteIndex = 0
-					case !h && l:
-						paletteIndex = 1
-					case h && !l:
-						paletteIndex = 2
-					case h && l:
-						paletteIndex = 3
-					}
-
-					x := tileMapX*8 + tileX
-					y := tileMapY*8 + tileY
-					bg[y][x] = palette[paletteIndex]
-				}
-			}
-		}
-	}
-
-	// Update the screen.
-	SCX := st.readMem(0xFF43)
-	SCY := st.readMem(0xFF42)
-	for y := 0; y < 144; y++ {
-		for x := 0; x < 160; x++ {
-			bgX := SCX + u8(x)
-			bgY := SCY + u8(y)
-			screen[y][x] = bg[bgY][bgX]
-		}
+	// The audio would crackle at other speeds.
+	if gui.audio != nil && gui.speed() == 1 {
+		gui.audio.queue(samples)
 	}
 }
 
@@ -244,6 +216,37 @@ func (gui *gui) processEvents() bool {
 			if event.WindowID == sdl.WINDOWEVENT_CLOSE {
 				return false
 			}
+		case *sdl.KeyboardEvent:
+			if event.Repeat != 0 {
+				break
+			}
+			action, ok := gui.keyBindings[event.Keysym.Sym]
+			if !ok {
+				break
+			}
+			pressed := event.State == sdl.PRESSED
+			if bit := buttonBit(action); bit >= 0 {
+				gui.keyboardButtons = setBit(gui.keyboardButtons, uint(bit), pressed)
+			} else {
+				gui.hotkey(action, pressed)
+			}
+		case *sdl.ControllerDeviceEvent:
+			switch event.Type {
+			case sdl.CONTROLLERDEVICEADDED:
+				// Which is the device index.
+				gui.addController(int(event.Which))
+			case sdl.CONTROLLERDEVICEREMOVED:
+				// Which is the instance id.
+				gui.removeController(event.Which)
+			}
+		case *sdl.ControllerButtonEvent:
+			if controller, ok := gui.controllers[event.Which]; ok {
+				controller.setButton(event.Button, event.State == sdl.PRESSED)
+			}
+		case *sdl.ControllerAxisEvent:
+			if controller, ok := gui.controllers[event.Which]; ok {
+				controller.setAxis(event.Axis, event.Value)
+			}
 		}
 	}
 }
@@ -253,16 +256,18 @@ func (gui *gui) close() {
 		gui.recorder.close()
 	}
 
+	if gui.audio != nil {
+		gui.audio.close()
+	}
+
+	// Stop the motors.
+	gui.setMotor(false)
+	for id := range gui.controllers {
+		gui.removeController(id)
+	}
+
 	gui.texture.Destroy()
 	gui.renderer.Destroy()
 	gui.window.Destroy()
 	sdl.Quit()
 }
-
-func getScanline(st *st) u8 {
-	// The LCD takes 456 cycles to draw one line.
-	// It has 154 lines (144 visible lines + 10 "V-blank lines").
-	scanline := (st.timing.cycles / 456) % 154
-	assert(0 <= scanline && scanline <= 153)
-	return u8(scanline)
-}
@@ -0,0 +1,143 @@
+/*
+ * gammaboy is a Game Boy emulator.
+ * Copyright (C) 2018  gammpei
+ *
+ * This file is part of gammaboy.
+ *
+ * gammaboy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * gammaboy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with gammaboy.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+	"sync"
+)
+
+// Writes the APU output to a 16-bit stereo WAV file.
+type wavWriter struct {
+	// The emulator can be closed from another goroutine while it is running.
+	mutex    sync.Mutex
+	file     *os.File // nil once closed.
+	writer   *bufio.Writer
+	dataSize u32 // In bytes.
+}
+
+func newWavWriter(path string) *wavWriter {
+	file, err := os.Create(path)
+	check(err)
+
+	wav := &wavWriter{
+		file:     file,
+		writer:   bufio.NewWriter(file),
+		dataSize: 0,
+	}
+	// The sizes are filled in by close.
+	wav.writeHeader()
+	return wav
+}
+
+func (wav *wavWriter) writeHeader() {
+	const channels = 2
+	const bitsPerSample = 16
+	const blockAlign = channels * bitsPerSample / 8
+
+	header := []interface{}{
+		[4]u8{'R', 'I', 'F', 'F'},
+		u32(36 + wav.dataSize), // The size of the rest of the file.
+		[4]u8{'W', 'A', 'V', 'E'},
+
+		[4]u8{'f', 'm', 't', ' '},
+		u32(16),                         // The size of the fmt chunk.
+		u16(1),                          // PCM
+		u16(channels),                   //
+		u32(apuSampleRate),              // Sample rate
+		u32(apuSampleRate * blockAlign), // Byte rate
+		u16(blockAlign),                 //
+		u16(bitsPerSample),              //
+
+		[4]u8{'d', 'a', 't', 'a'},
+		wav.dataSize,
+	}
+	for _, field := range header {
+		err := binary.Write(wav.writer, binary.LittleEndian, field)
+		check(err)
+	}
+}
+
+// samples are the APU samples, interleaved left and right.
+func (wav *wavWriter) write(samples []float32) {
+	wav.mutex.Lock()
+	defer wav.mutex.Unlock()
+	if wav.file == nil {
+		return
+	}
+
+	for _, sample := range samples {
+		if sample > 1 {
+			sample = 1
+		} else if sample < -1 {
+			sample = -1
+		}
+		err := binary.Write(wav.writer, binary.LittleEndian, int16(sample*32767))
+		check(err)
+	}
+	wav.dataSize += u32(len(samples) * 2)
+}
+
+// Removes the last samples.
+func (wav *wavWriter) truncate(nbSamples int) {
+	wav.mutex.Lock()
+	defer wav.mutex.Unlock()
+	if wav.file == nil {
+		return
+	}
+
+	err := wav.writer.Flush()
+	check(err)
+
+	size := u32(nbSamples * 2)
+	assert(size <= wav.dataSize)
+	wav.dataSize -= size
+	end := int64(44 + wav.dataSize)
+	err = wav.file.Truncate(end)
+	check(err)
+	_, err = wav.file.Seek(end, 0)
+	check(err)
+}
+
+func (wav *wavWriter) close() {
+	wav.mutex.Lock()
+	defer wav.mutex.Unlock()
+	if wav.file == nil {
+		return
+	}
+
+	err := wav.writer.Flush()
+	check(err)
+
+	// Rewrite the header now that we know the sizes.
+	_, err = wav.file.Seek(0, 0)
+	check(err)
+	wav.writer = bufio.NewWriter(wav.file)
+	wav.writeHeader()
+	err = wav.writer.Flush()
+	check(err)
+
+	err = wav.file.Close()
+	check(err)
+	wav.file = nil
+}
@@ -0,0 +1,89 @@
+/*
+ * gammaboy is a Game Boy emulator.
+ * Copyright (C) 2018  gammpei
+ *
+ * This file is part of gammaboy.
+ *
+ * gammaboy is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * gammaboy is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with gammaboy.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWavWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gammaboy")
+	check(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audio.wav")
+
+	wav := newWavWriter(path)
+	wav.write([]float32{0, 0, 1, -1})
+	wav.write([]float32{2, 0.5})
+	wav.close()
+	wav.write([]float32{0, 0}) // Ignored after close.
+
+	file, err := ioutil.ReadFile(path)
+	check(err)
+	if len(file) != 44+6*2 {
+		t.Fatalf("Expected %d bytes, got %d.", 44+6*2, len(file))
+	}
+	if string(file[0:4]) != "RIFF" || string(file[8:16]) != "WAVEfmt " || string(file[36:40]) != "data" {
+		t.Fatalf("Invalid WAV header.")
+	}
+	if size := binary.LittleEndian.Uint32(file[4:]); size != 36+6*2 {
+		t.Fatalf("Expected a RIFF size of %d, got %d.", 36+6*2, size)
+	}
+	if rate := binary.LittleEndian.Uint32(file[24:]); rate != apuSampleRate {
+		t.Fatalf("Expected a sample rate of %d, got %d.", apuSampleRate, rate)
+	}
+	if size := binary.LittleEndian.Uint32(file[40:]); size != 6*2 {
+		t.Fatalf("Expected a data size of %d, got %d.", 6*2, size)
+	}
+
+	expected := []int16{0, 0, 32767, -32767, 32767, 16383}
+	for i, sample := range expected {
+		if actual := int16(binary.LittleEndian.Uint16(file[44+i*2:])); actual != sample {
+			t.Fatalf("Expected sample %d to be %d, got %d.", i, sample, actual)
+		}
+	}
+}
+
+func TestWavWriterTruncate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gammaboy")
+	check(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audio.wav")
+
+	wav := newWavWriter(path)
+	wav.write([]float32{0.5, 0.5, 1, 1})
+	wav.truncate(2)
+	wav.write([]float32{-1, -1})
+	wav.close()
+
+	file, err := ioutil.ReadFile(path)
+	check(err)
+	if size := binary.LittleEndian.Uint32(file[40:]); size != 4*2 || len(file) != 44+4*2 {
+		t.Fatalf("Expected a data size of %d, got %d (%d bytes in the file).", 4*2, size, len(file))
+	}
+	if last := int16(binary.LittleEndian.Uint16(file[44+3*2:])); last != -32767 {
+		t.Fatalf("Expected the last sample to be -32767, got %d.", last)
+	}
+}